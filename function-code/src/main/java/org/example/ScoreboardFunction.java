@@ -1,10 +1,11 @@
 package org.example;
 
+import java.nio.ByteBuffer;
 import java.util.HashMap;
 import java.util.Optional;
 import org.apache.pulsar.client.api.PulsarClientException;
 import org.apache.pulsar.client.api.Schema;
-import org.apache.pulsar.client.impl.schema.generic.GenericJsonRecord;
+import org.apache.pulsar.client.api.schema.GenericRecord;
 import org.apache.pulsar.common.functions.ConsumerConfig;
 import org.apache.pulsar.common.functions.FunctionConfig;
 import org.apache.pulsar.functions.LocalRunner;
@@ -12,15 +13,38 @@ import org.apache.pulsar.functions.api.Context;
 import org.apache.pulsar.functions.api.Function;
 
 
-public class ScoreboardFunction implements Function<GenericJsonRecord, Void> {
+// the input is a GenericRecord, so the game can send events with the json or avro codec
+public class ScoreboardFunction implements Function<GenericRecord, Void> {
+
+    // a running room server publishes RoomHostedEvent every 5 seconds, the
+    // room is hosted until 15 seconds after the last one, see hostedLeaseTime
+    // of the game
+    private static final long HOSTED_LEASE_MILLIS = 15000;
 
     @Override
-    public Void process(GenericJsonRecord input, Context context) {
+    public Void process(GenericRecord input, Context context) {
+
+        String type = String.valueOf(input.getField("type"));
+        long publishTime = context.getCurrentRecord().getMessage()
+                .map(m -> m.getPublishTime())
+                .orElse(System.currentTimeMillis());
+
+        // the room is scored by its state topic only while its room server
+        // renews the lease, and the event topic is scored again when the
+        // server stops with RoomUnhostedEvent or its lease expires
+        Optional<String> sourceTopic = context.getCurrentRecord().getTopicName();
+        if (sourceTopic.isPresent() && sourceTopic.get().endsWith("-state-topic")) {
+            String hostedKey = parseRoomName(sourceTopic.get()).get() + "-hosted-until";
+            if (type.equals("RoomHostedEvent")) {
+                putLong(context, hostedKey, publishTime + HOSTED_LEASE_MILLIS);
+            } else if (type.equals("RoomUnhostedEvent")) {
+                putLong(context, hostedKey, 0);
+            }
+        }
 
-        String type = (String) input.getField("type");
         if (type.equals("UserDeadEvent")) {
-            String player = (String) input.getField("name");
-            String killer = (String) input.getField("comment");
+            String player = String.valueOf(input.getField("name"));
+            String killer = String.valueOf(input.getField("comment"));
            if (player.equals(killer)) {
                // kill himself
                return null;
@@ -36,9 +60,16 @@ public class ScoreboardFunction implements Function<GenericJsonRecord, Void> {
             if (outputTopic.isEmpty()) {
                 return null;
             }
+            String roomName = parseRoomName(inputTopic.get()).get();
+            // a room with a room server is scored by its state topic only,
+            // the dead events in its event topic are sent by players
+            String hostedKey = roomName + "-hosted-until";
+            if (!inputTopic.get().endsWith("-state-topic") && publishTime < getLong(context, hostedKey)) {
+                return null;
+            }
             // roomName-playerName as the stateful key  /
             // store the score in stateful function
-            String killerKey = parseRoomName(inputTopic.get()).get() + "-" + killer;
+            String killerKey = roomName + "-" + killer;
             context.incrCounter(killerKey, 1);
 
             // send the score messages to score topic
@@ -57,8 +88,27 @@ public class ScoreboardFunction implements Function<GenericJsonRecord, Void> {
         return null;
     }
 
+    private void putLong(Context context, String key, long value) {
+        ByteBuffer buffer = ByteBuffer.allocate(Long.BYTES);
+        buffer.putLong(0, value);
+        context.putState(key, buffer);
+    }
+
+    // getLong returns 0 if the key has no state
+    private long getLong(Context context, String key) {
+        ByteBuffer buffer = context.getState(key);
+        if (buffer == null || buffer.remaining() < Long.BYTES) {
+            return 0;
+        }
+        return buffer.getLong(buffer.position());
+    }
+
     private Optional<String> parseRoomName(String eventTopicName) {
         int i = eventTopicName.lastIndexOf("-event-topic");
+        if (i < 0) {
+            // the events accepted by the room server
+            i = eventTopicName.lastIndexOf("-state-topic");
+        }
         if (i < 0) {
             return Optional.empty();
         }
@@ -80,10 +130,12 @@ public class ScoreboardFunction implements Function<GenericJsonRecord, Void> {
         functionConfig.setName("score-board-function");
 
         String inputTopic = ".*-event-topic";
+        String stateTopic = ".*-state-topic";
         // enable regex support to subscribe multiple topics
         HashMap<String, ConsumerConfig> inputSpecs = new HashMap<>();
         ConsumerConfig consumerConfig = ConsumerConfig.builder().isRegexPattern(true).build();
         inputSpecs.put(inputTopic, consumerConfig);
+        inputSpecs.put(stateTopic, consumerConfig);
         functionConfig.setInputSpecs(inputSpecs);
 
         functionConfig.setClassName(ScoreboardFunction.class.getName());
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// a bot acts every botActionTicks, a bit slower than a human
+	botActionTicks = ticksPerSecond / 4
+	// a dead bot revives after botReviveTicks
+	botReviveTicks = 3 * ticksPerSecond
+)
+
+var botDirections = []Direction{dirLeft, dirRight, dirUp, dirDown}
+
+// botStrategy decides what a bot does with the world it sees
+type botStrategy interface {
+	// next returns whether to set a bomb where the bot stands, and then
+	// where to move, dirNone to stay
+	next(w *World, me *playerInfo) (bomb bool, dir Direction)
+}
+
+// botStrategies are the strategies of -strategy
+var botStrategies = map[string]func(rnd *rand.Rand) botStrategy{
+	"random": func(rnd *rand.Rand) botStrategy {
+		return &randomWalkStrategy{rnd: rnd}
+	},
+	"careful": func(rnd *rand.Rand) botStrategy {
+		return &carefulStrategy{rnd: rnd}
+	},
+}
+
+// bot plays a gameSession by a strategy, it sends the same events as a human
+type bot struct {
+	*gameSession
+	strategy botStrategy
+	closeCh  chan struct{}
+	stopOnce sync.Once
+	// closed when run returns
+	doneCh chan struct{}
+}
+
+func newBot(playerName, roomName string, authoritative bool, strategyName string) (*bot, error) {
+	newStrategy, ok := botStrategies[strategyName]
+	if !ok {
+		return nil, fmt.Errorf("unknown strategy %q", strategyName)
+	}
+	session, err := newGameSession(playerName, roomName, authoritative)
+	if err != nil {
+		return nil, err
+	}
+	return &bot{
+		gameSession: session,
+		strategy:    newStrategy(rand.New(rand.NewSource(time.Now().UnixNano()))),
+		closeCh:     make(chan struct{}),
+		doneCh:      make(chan struct{}),
+	}, nil
+}
+
+// run steps the session like Update of BombGame until Close
+func (b *bot) run() {
+	defer close(b.doneCh)
+	ticker := time.NewTicker(time.Second / ticksPerSecond)
+	defer ticker.Stop()
+	var ticks, deadTicks int
+	for {
+		select {
+		case <-ticker.C:
+		case <-b.closeCh:
+			return
+		}
+		if b.client.replacedByNewSession() {
+			log.Warning("[bot] ", errSessionReplaced)
+			return
+		}
+		b.step()
+		ticks++
+		me := b.world.localPlayer()
+		if !me.alive {
+			deadTicks++
+			if deadTicks >= botReviveTicks {
+				deadTicks = 0
+				b.revive()
+			}
+			continue
+		}
+		deadTicks = 0
+		// the speed power-ups make a bot act more often, up to every tick
+		interval := botActionTicks / me.powerUps.speed()
+		if interval < 1 {
+			interval = 1
+		}
+		if ticks%interval != 0 {
+			continue
+		}
+		bomb, dir := b.strategy.next(b.world, me)
+		if bomb {
+			b.placeBomb()
+		}
+		if dir != dirNone {
+			b.move(dir)
+		}
+	}
+}
+
+// stop stops playing and waits for run to return, the session stays in the room
+func (b *bot) stop() {
+	b.stopOnce.Do(func() {
+		close(b.closeCh)
+	})
+	<-b.doneCh
+}
+
+// Close leaves the room, run must have been started
+func (b *bot) Close() {
+	b.stop()
+	b.gameSession.Close()
+}
+
+// runBots runs count bots in the room until stopCh is closed, the bots are
+// named playerName with a number, or random names
+func runBots(playerName, roomName string, authoritative bool, strategyName string, count int, stopCh chan struct{}) error {
+	var bots []*bot
+	defer func() {
+		for _, b := range bots {
+			b.Close()
+		}
+	}()
+	for i := 0; i < count; i++ {
+		// the name of player can't contain '-', it splits the bomb name
+		name := "bot" + randStringRunes(4)
+		if playerName != "" {
+			name = playerName
+			if count > 1 {
+				name = fmt.Sprintf("%s%d", playerName, i)
+			}
+		}
+		b, err := newBot(name, roomName, authoritative, strategyName)
+		if err != nil {
+			return err
+		}
+		bots = append(bots, b)
+		go b.run()
+		log.Info("bot joined: ", name)
+	}
+	<-stopCh
+	return nil
+}
+
+// randomWalkStrategy walks randomly and sometimes sets a bomb
+type randomWalkStrategy struct {
+	rnd *rand.Rand
+}
+
+func (s *randomWalkStrategy) next(w *World, me *playerInfo) (bool, Direction) {
+	var dirs []Direction
+	for _, dir := range botDirections {
+		if p := w.settings.getNextPosition(me.pos, dir); p != me.pos && botPassable(w, p) {
+			dirs = append(dirs, dir)
+		}
+	}
+	bomb := s.rnd.Intn(10) == 0
+	if len(dirs) == 0 {
+		return bomb, dirNone
+	}
+	return bomb, dirs[s.rnd.Intn(len(dirs))]
+}
+
+// carefulStrategy keeps out of the flames and the range of bombs, collects
+// power-ups, and sets bombs near destructible obstacles and players when it
+// can run away
+type carefulStrategy struct {
+	rnd *rand.Rand
+}
+
+func (s *carefulStrategy) next(w *World, me *playerInfo) (bool, Direction) {
+	danger := botDangerMap(w)
+	safe := func(p Position) bool {
+		return !danger[p]
+	}
+	if danger[me.pos] {
+		// run to the nearest safe grid
+		dir, _ := botPath(w, me.pos, botInFlame(w), safe, -1)
+		return false, dir
+	}
+
+	if w.canSetBomb(me.name, me.pos) && s.worthBombing(w, me) {
+		// can the bot escape before its bomb explodes?
+		withBomb := map[Position]bool{}
+		for p := range danger {
+			withBomb[p] = true
+		}
+		for _, p := range botFlameOf(w, me.pos, w.bombLength(me.name)) {
+			withBomb[p] = true
+		}
+		maxSteps := int(w.settings.explodeTicks()/botActionTicks) - 1
+		dir, ok := botPath(w, me.pos, botInFlame(w), func(p Position) bool {
+			return !withBomb[p]
+		}, maxSteps)
+		if ok {
+			return true, dir
+		}
+	}
+
+	// go to a power-up or somewhere worth bombing without entering the danger
+	dir, ok := botPath(w, me.pos, func(p Position) bool {
+		return danger[p]
+	}, func(p Position) bool {
+		if _, ok := w.powerUps[p]; ok {
+			return true
+		}
+		return s.worthBombing(w, &playerInfo{name: me.name, pos: p})
+	}, -1)
+	if ok && dir != dirNone {
+		return false, dir
+	}
+	var dirs []Direction
+	for _, dir := range botDirections {
+		if p := w.settings.getNextPosition(me.pos, dir); p != me.pos && botPassable(w, p) && !danger[p] {
+			dirs = append(dirs, dir)
+		}
+	}
+	if len(dirs) == 0 {
+		return false, dirNone
+	}
+	return false, dirs[s.rnd.Intn(len(dirs))]
+}
+
+// worthBombing returns true if the flame at me reaches other players or a
+// destructible obstacle next to me
+func (s *carefulStrategy) worthBombing(w *World, me *playerInfo) bool {
+	for _, dir := range botDirections {
+		p := w.settings.getNextPosition(me.pos, dir)
+		if t, ok := w.obstacleMap[p]; ok && t == destructibleObstacleType {
+			return true
+		}
+	}
+	flame := map[Position]bool{}
+	for _, p := range botFlameOf(w, me.pos, w.bombLength(me.name)) {
+		flame[p] = true
+	}
+	for name, player := range w.nameToPlayers {
+		if name != me.name && player.alive && flame[player.pos] {
+			return true
+		}
+	}
+	return false
+}
+
+// botFlameOf returns the grids in the flame of a bomb at pos
+func botFlameOf(w *World, pos Position, length int) []Position {
+	return w.settings.getExplodeFlame(pos, length, func(p Position) bool {
+		t, ok := w.obstacleMap[p]
+		return !ok || t != indestructibleObstacleType
+	})
+}
+
+// botDangerMap returns the grids in flames or in the range of bombs
+func botDangerMap(w *World) map[Position]bool {
+	danger := map[Position]bool{}
+	for p, bomb := range w.flameMap {
+		if bomb != nil {
+			danger[p] = true
+		}
+	}
+	for pos, bomb := range w.posToBombs {
+		for _, p := range botFlameOf(w, pos, bomb.length) {
+			danger[p] = true
+		}
+	}
+	return danger
+}
+
+// botInFlame returns if p is in flame now, moving there is dead
+func botInFlame(w *World) func(p Position) bool {
+	return func(p Position) bool {
+		return w.flameMap[p] != nil
+	}
+}
+
+// botPassable returns true if a player can move to p
+func botPassable(w *World, p Position) bool {
+	if !w.settings.validCoordinate(p) {
+		return false
+	}
+	if _, ok := w.obstacleMap[p]; ok {
+		return false
+	}
+	_, ok := w.posToBombs[p]
+	return !ok
+}
+
+// botPath searches the nearest grid matching goal, without passing the
+// grids to avoid, and returns the first step to it. maxSteps < 0 means no limit.
+func botPath(w *World, from Position, avoid, goal func(p Position) bool, maxSteps int) (Direction, bool) {
+	if goal(from) {
+		return dirNone, true
+	}
+	type node struct {
+		pos   Position
+		first Direction
+		steps int
+	}
+	visited := map[Position]bool{from: true}
+	queue := []node{{pos: from}}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		if maxSteps >= 0 && n.steps >= maxSteps {
+			continue
+		}
+		for _, dir := range botDirections {
+			p := w.settings.getNextPosition(n.pos, dir)
+			if visited[p] || !botPassable(w, p) {
+				continue
+			}
+			if avoid(p) {
+				continue
+			}
+			visited[p] = true
+			first := n.first
+			if n.pos == from {
+				first = dir
+			}
+			if goal(p) {
+				return first, true
+			}
+			queue = append(queue, node{pos: p, first: first, steps: n.steps + 1})
+		}
+	}
+	return dirNone, false
+}
+
+// botStrategyNames lists the strategies for the usage
+func botStrategyNames() []string {
+	var names []string
+	for name := range botStrategies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
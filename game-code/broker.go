@@ -0,0 +1,437 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errProducerBusy = errors.New("producer with the same name is already connected")
+
+// memoryBroker stands in for a Pulsar cluster inside the process. It keeps
+// an ordered log for every topic, durable subscriptions with cursors,
+// readers, key compacted table views and the score function.
+type memoryBroker struct {
+	lock sync.Mutex
+	// broadcast when a topic receives a message or a consumer is closed
+	cond   *sync.Cond
+	topics map[string]*brokerTopic
+	// functions run on every message published to a topic with the suffix,
+	// like the pulsar function deployed by regex topic pattern
+	functions map[string]brokerFunction
+	// held from publishing a keyed message until its table listeners are
+	// called, so they see the values of a key in order
+	tableLock sync.Mutex
+}
+
+// brokerFunction processes a message of topic, it's called with the broker lock released
+type brokerFunction func(b *memoryBroker, topic string, msg *brokerMessage)
+
+type brokerTopic struct {
+	log           []*brokerMessage
+	subscriptions map[string]*brokerSubscription
+	// the transports publishing with a producer name
+	producers map[string]*memoryTransport
+	// called on every message published with a key
+	tableListeners []func(key, value string)
+}
+
+type brokerMessage struct {
+	offset      int
+	publishTime time.Time
+	// key and value of the table topics
+	key, value string
+	producer   string
+	event      *EventMessage
+}
+
+type brokerSubscription struct {
+	name      string
+	exclusive bool
+	// offset of the next message to deliver
+	cursor    int
+	consumers []*brokerConsumer
+}
+
+type brokerConsumer struct {
+	topic        string
+	subscription *brokerSubscription
+	outCh        chan *receivedMessage
+	closeCh      chan struct{}
+	// offset of the message on its way to outCh, -1 if there is none
+	delivering int
+}
+
+func newMemoryBroker() *memoryBroker {
+	b := &memoryBroker{
+		topics:    map[string]*brokerTopic{},
+		functions: map[string]brokerFunction{},
+	}
+	b.cond = sync.NewCond(&b.lock)
+	return b
+}
+
+// getTopic must be called with the lock held
+func (b *memoryBroker) getTopic(name string) *brokerTopic {
+	t, ok := b.topics[name]
+	if !ok {
+		t = &brokerTopic{
+			subscriptions: map[string]*brokerSubscription{},
+			producers:     map[string]*memoryTransport{},
+		}
+		b.topics[name] = t
+	}
+	return t
+}
+
+// registerFunction runs f on every message of the topics ending with suffix
+func (b *memoryBroker) registerFunction(suffix string, f brokerFunction) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.functions[suffix] = f
+}
+
+// publish appends the message to the log of topic
+func (b *memoryBroker) publish(topic string, msg *brokerMessage) {
+	if msg.key != "" {
+		b.tableLock.Lock()
+	}
+	b.lock.Lock()
+	t := b.getTopic(topic)
+	msg.offset = len(t.log)
+	msg.publishTime = time.Now()
+	t.log = append(t.log, msg)
+	listeners := t.tableListeners
+	var functions []brokerFunction
+	for suffix, f := range b.functions {
+		if strings.HasSuffix(topic, suffix) {
+			functions = append(functions, f)
+		}
+	}
+	b.cond.Broadcast()
+	b.lock.Unlock()
+
+	if msg.key != "" {
+		for _, f := range listeners {
+			f(msg.key, msg.value)
+		}
+		b.tableLock.Unlock()
+	}
+	for _, f := range functions {
+		f(b, topic, msg)
+	}
+}
+
+// addProducer gives the producer name on topic to the transport, a name
+// is used by one connected transport at a time
+func (b *memoryBroker) addProducer(topic, name string, owner *memoryTransport) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	t := b.getTopic(topic)
+	if p, ok := t.producers[name]; ok && p != owner {
+		return errProducerBusy
+	}
+	t.producers[name] = owner
+	return nil
+}
+
+// removeProducer releases the producer name of the transport
+func (b *memoryBroker) removeProducer(topic, name string, owner *memoryTransport) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	t := b.getTopic(topic)
+	if t.producers[name] == owner {
+		delete(t.producers, name)
+	}
+}
+
+// subscribe attaches a consumer to the subscription, the subscription is
+// created at initial position if it doesn't exist, otherwise the consumer
+// resumes from the acknowledged cursor
+func (b *memoryBroker) subscribe(topic, subscriptionName string, exclusive bool, initial position) (*brokerConsumer, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	t := b.getTopic(topic)
+	s, ok := t.subscriptions[subscriptionName]
+	if !ok {
+		s = &brokerSubscription{
+			name:      subscriptionName,
+			exclusive: exclusive,
+		}
+		if !initial.earliest {
+			s.cursor = len(t.log)
+		}
+		t.subscriptions[subscriptionName] = s
+	}
+	if (s.exclusive || exclusive) && len(s.consumers) > 0 {
+		return nil, errExclusiveConsumerBusy
+	}
+	s.exclusive = exclusive
+	c := &brokerConsumer{
+		topic:        topic,
+		subscription: s,
+		outCh:        make(chan *receivedMessage),
+		closeCh:      make(chan struct{}),
+		delivering:   -1,
+	}
+	s.consumers = append(s.consumers, c)
+	go b.dispatch(c)
+	return c, nil
+}
+
+// dispatch delivers the messages of the subscription to the consumer,
+// consumers of a shared subscription take turns
+func (b *memoryBroker) dispatch(c *brokerConsumer) {
+	for {
+		b.lock.Lock()
+		t := b.getTopic(c.topic)
+		for c.subscription.cursor >= len(t.log) && !c.closed() {
+			b.cond.Wait()
+		}
+		if c.closed() {
+			b.lock.Unlock()
+			return
+		}
+		msg := t.log[c.subscription.cursor]
+		// acknowledge when delivered
+		c.subscription.cursor++
+		c.delivering = msg.offset
+		b.lock.Unlock()
+
+		select {
+		case c.outCh <- msg.received():
+			b.lock.Lock()
+			c.delivering = -1
+			b.lock.Unlock()
+		case <-c.closeCh:
+			// not delivered, closeConsumer gave it back
+			return
+		}
+	}
+}
+
+// seek resets the cursor of the subscription
+func (b *memoryBroker) seek(c *brokerConsumer, start position) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	t := b.getTopic(c.topic)
+	if start.earliest || start.id != nil || !start.publishTime.IsZero() {
+		c.subscription.cursor = t.find(start)
+	} else {
+		c.subscription.cursor = len(t.log)
+	}
+}
+
+// closeConsumer detaches the consumer, the subscription and its cursor stay
+func (b *memoryBroker) closeConsumer(c *brokerConsumer) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if c.closed() {
+		return
+	}
+	close(c.closeCh)
+	s := c.subscription
+	if c.delivering >= 0 && s.cursor == c.delivering+1 {
+		// redeliver the message on its way to the next consumer, before
+		// another one can subscribe
+		s.cursor = c.delivering
+	}
+	for i, consumer := range s.consumers {
+		if consumer == c {
+			s.consumers = append(s.consumers[:i], s.consumers[i+1:]...)
+			break
+		}
+	}
+	b.cond.Broadcast()
+}
+
+// unsubscribe deletes the subscription, it fails if other consumers are connected
+func (b *memoryBroker) unsubscribe(c *brokerConsumer) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	s := c.subscription
+	for _, consumer := range s.consumers {
+		if consumer != c {
+			return errors.New("subscription has other connected consumers")
+		}
+	}
+	delete(b.getTopic(c.topic).subscriptions, s.name)
+	return nil
+}
+
+// offsetOf returns the offset where a reader starts, a latest reader
+// starts from the last message inclusively
+func (b *memoryBroker) offsetOf(topic string, start position) int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	t := b.getTopic(topic)
+	if start.earliest || start.id != nil || !start.publishTime.IsZero() {
+		return t.find(start)
+	}
+	offset := len(t.log) - 1
+	if offset < 0 {
+		offset = 0
+	}
+	return offset
+}
+
+// checkBrokerMessageID returns an error if id isn't an offset of the log
+func checkBrokerMessageID(id []byte) error {
+	if len(id) != 8 || binary.BigEndian.Uint64(id) > math.MaxInt64 {
+		return errors.New("not a message id of the memory broker")
+	}
+	return nil
+}
+
+// find returns the offset of the message id, or the first message
+// published since publishTime, or the earliest message
+func (t *brokerTopic) find(start position) int {
+	if len(start.id) == 8 {
+		// an id out of the log starts after its last message
+		offset := binary.BigEndian.Uint64(start.id)
+		if offset > uint64(len(t.log)) {
+			offset = uint64(len(t.log))
+		}
+		return int(offset)
+	}
+	if !start.publishTime.IsZero() {
+		return sort.Search(len(t.log), func(i int) bool {
+			return !t.log[i].publishTime.Before(start.publishTime)
+		})
+	}
+	return 0
+}
+
+// read blocks until the message at offset is published or ctx is done
+func (b *memoryBroker) read(ctx context.Context, topic string, offset int) (*brokerMessage, error) {
+	// wake up the waiting loop when ctx is done
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			b.lock.Lock()
+			b.cond.Broadcast()
+			b.lock.Unlock()
+		case <-done:
+		}
+	}()
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	t := b.getTopic(topic)
+	for offset >= len(t.log) {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		b.cond.Wait()
+	}
+	return t.log[offset], nil
+}
+
+func (b *memoryBroker) size(topic string) int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return len(b.getTopic(topic).log)
+}
+
+// listenTable calls f with the compacted topic, it's the latest value
+// of every key, and then with every new keyed message. f must not publish
+// keyed messages.
+func (b *memoryBroker) listenTable(topic string, f func(key, value string)) {
+	// no keyed message is published until the compacted values are delivered
+	b.tableLock.Lock()
+	defer b.tableLock.Unlock()
+	b.lock.Lock()
+	t := b.getTopic(topic)
+	compacted := map[string]string{}
+	var keys []string
+	for _, msg := range t.log {
+		if msg.key == "" {
+			continue
+		}
+		if _, ok := compacted[msg.key]; !ok {
+			keys = append(keys, msg.key)
+		}
+		compacted[msg.key] = msg.value
+	}
+	t.tableListeners = append(t.tableListeners, f)
+	b.lock.Unlock()
+
+	for _, key := range keys {
+		f(key, compacted[key])
+	}
+}
+
+func (c *brokerConsumer) closed() bool {
+	select {
+	case <-c.closeCh:
+		return true
+	default:
+		return false
+	}
+}
+
+func (m *brokerMessage) received() *receivedMessage {
+	id := make([]byte, 8)
+	binary.BigEndian.PutUint64(id, uint64(m.offset))
+	return &receivedMessage{
+		id:          id,
+		publishTime: m.publishTime,
+		producer:    m.producer,
+		event:       m.event,
+	}
+}
+
+// scoreboardFunction is the in-process ScoreboardFunction of function-code,
+// the killer of a UserDeadEvent gets one point in {room}-score-topic. A room
+// with a room server is scored by its state topic only, it's hosted until
+// hostedLeaseTime after the last RoomHostedEvent of the server, or until
+// its RoomUnhostedEvent.
+func scoreboardFunction() brokerFunction {
+	var lock sync.Mutex
+	counters := map[string]int{}
+	hostedUntil := map[string]time.Time{}
+	return func(b *memoryBroker, topic string, msg *brokerMessage) {
+		e := msg.event
+		if e == nil {
+			return
+		}
+		roomName := strings.TrimSuffix(strings.TrimSuffix(topic, "-event-topic"), "-state-topic")
+		if strings.HasSuffix(topic, "-state-topic") {
+			lock.Lock()
+			switch e.Type {
+			case RoomHostedEventType:
+				hostedUntil[roomName] = msg.publishTime.Add(hostedLeaseTime)
+			case RoomUnhostedEventType:
+				delete(hostedUntil, roomName)
+			}
+			lock.Unlock()
+		}
+		if e.Type != UserDeadEventType || e.Name == e.Comment {
+			return
+		}
+		killer := e.Comment
+
+		lock.Lock()
+		if !strings.HasSuffix(topic, "-state-topic") && msg.publishTime.Before(hostedUntil[roomName]) {
+			// the dead events of players can't be trusted
+			lock.Unlock()
+			return
+		}
+		counters[roomName+"-"+killer]++
+		score := counters[roomName+"-"+killer]
+		lock.Unlock()
+
+		b.publish(roomName+"-score-topic", &brokerMessage{
+			key:   killer,
+			value: strconv.Itoa(score),
+		})
+	}
+}
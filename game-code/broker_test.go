@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestTransport(t *testing.T, b *memoryBroker, producerName string) *memoryTransport {
+	t.Helper()
+	codec, err := newEventCodec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := newMemoryTransport(b, codec, producerName)
+	t.Cleanup(transport.Close)
+	return transport
+}
+
+// publishNames publishes a message named by every name to topic, and
+// returns their ids
+func publishNames(t *testing.T, transport Transport, topic string, names ...string) [][]byte {
+	t.Helper()
+	var ids [][]byte
+	for _, name := range names {
+		id, err := transport.publish(topic, "", &EventMessage{Type: UserMoveEventType, Name: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func TestMemoryBrokerExclusiveSubscription(t *testing.T) {
+	tests := []struct {
+		name string
+		// the first consumer, and the second one of the subscription
+		firstExclusive, secondExclusive bool
+		// the second consumer subscribes to another subscription
+		otherSubscription bool
+		// the first consumer is closed before the second subscribes
+		closeFirst bool
+		wantErr    error
+	}{
+		{name: "exclusive twice", firstExclusive: true, secondExclusive: true, wantErr: errExclusiveConsumerBusy},
+		{name: "shared after exclusive", firstExclusive: true, wantErr: errExclusiveConsumerBusy},
+		{name: "exclusive after shared", secondExclusive: true, wantErr: errExclusiveConsumerBusy},
+		{name: "shared twice"},
+		{name: "another subscription", firstExclusive: true, secondExclusive: true, otherSubscription: true},
+		{name: "after the first is closed", firstExclusive: true, secondExclusive: true, closeFirst: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := newTestTransport(t, newMemoryBroker(), "")
+			first, err := transport.subscribe("room-event-topic", "ann", tt.firstExclusive)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.closeFirst {
+				first.Close()
+			}
+			subscriptionName := "ann"
+			if tt.otherSubscription {
+				subscriptionName = "bob"
+			}
+			_, err = transport.subscribe("room-event-topic", subscriptionName, tt.secondExclusive)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("subscribe returns %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMemoryBrokerSubscriptionResumes(t *testing.T) {
+	b := newMemoryBroker()
+	transport := newTestTransport(t, b, "")
+	s, err := transport.subscribe("room-event-topic", "ann", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publishNames(t, transport, "room-event-topic", "a", "b", "c")
+	if msg := <-s.receive(); msg.event.Name != "a" {
+		t.Fatalf("receive %s, want a", msg.event.Name)
+	}
+	// let the consumer take b on its way
+	time.Sleep(10 * time.Millisecond)
+	s.Close()
+
+	// a new consumer resumes after the acknowledged message
+	s, err = transport.subscribe("room-event-topic", "ann", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for _, want := range []string{"b", "c"} {
+		select {
+		case msg := <-s.receive():
+			if msg.event.Name != want {
+				t.Fatalf("receive %s, want %s", msg.event.Name, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s is not received", want)
+		}
+	}
+}
+
+func TestMemoryBrokerReader(t *testing.T) {
+	b := newMemoryBroker()
+	transport := newTestTransport(t, b, "")
+	ids := publishNames(t, transport, "room-event-topic", "a", "b")
+	// the messages after since are published later
+	time.Sleep(10 * time.Millisecond)
+	since := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	ids = append(ids, publishNames(t, transport, "room-event-topic", "c")...)
+
+	tests := []struct {
+		name  string
+		start position
+		want  []string
+	}{
+		{name: "earliest", start: earliestPosition, want: []string{"a", "b", "c"}},
+		{name: "latest", start: latestPosition, want: []string{"c"}},
+		{name: "message id", start: position{id: ids[1]}, want: []string{"b", "c"}},
+		{name: "publish time", start: position{publishTime: since}, want: []string{"c"}},
+		{name: "id after the log", start: position{id: []byte{0, 0, 0, 0, 0, 0, 0, 9}}},
+		{name: "id out of int", start: position{id: []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader, err := transport.createReader("room-event-topic", tt.start)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reader.Close()
+			var got []string
+			for reader.hasNext() {
+				msg, err := reader.next(context.Background())
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, msg.event.Name)
+			}
+			if !equalStrings(got, tt.want) {
+				t.Fatalf("read %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMemoryBrokerTableView(t *testing.T) {
+	tests := []struct {
+		name string
+		// key=value published before and after listening
+		before, after [][2]string
+		want          map[string]string
+	}{
+		{name: "empty"},
+		{
+			name:   "latest value of every key",
+			before: [][2]string{{"ann", "1"}, {"bob", "1"}, {"ann", "2"}},
+			want:   map[string]string{"ann": "2", "bob": "1"},
+		},
+		{
+			name:   "updates",
+			before: [][2]string{{"ann", "1"}},
+			after:  [][2]string{{"ann", "2"}, {"cat", "1"}},
+			want:   map[string]string{"ann": "2", "cat": "1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newMemoryBroker()
+			for _, kv := range tt.before {
+				b.publish("room-score-topic", &brokerMessage{key: kv[0], value: kv[1]})
+			}
+			got := map[string]string{}
+			b.listenTable("room-score-topic", func(key, value string) {
+				got[key] = value
+			})
+			for _, kv := range tt.after {
+				b.publish("room-score-topic", &brokerMessage{key: kv[0], value: kv[1]})
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("table %v, want %v", got, tt.want)
+			}
+			for key, value := range tt.want {
+				if got[key] != value {
+					t.Fatalf("table %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestMemoryBrokerTableViewKeepsOrder(t *testing.T) {
+	b := newMemoryBroker()
+	b.publish("room-score-topic", &brokerMessage{key: "ann", value: "1"})
+	b.publish("room-score-topic", &brokerMessage{key: "bob", value: "1"})
+	published := make(chan struct{})
+	var lock sync.Mutex
+	got := map[string]string{}
+	b.listenTable("room-score-topic", func(key, value string) {
+		if key == "ann" && value == "1" {
+			// publish a new value of bob while the compacted values are delivered
+			go func() {
+				defer close(published)
+				b.publish("room-score-topic", &brokerMessage{key: "bob", value: "2"})
+			}()
+			time.Sleep(10 * time.Millisecond)
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		got[key] = value
+	})
+	<-published
+	lock.Lock()
+	defer lock.Unlock()
+	if got["bob"] != "2" {
+		t.Fatalf("bob is %s in the table after 2 is published", got["bob"])
+	}
+}
+
+func TestMemoryBrokerProducerName(t *testing.T) {
+	b := newMemoryBroker()
+	ann := newTestTransport(t, b, "ann")
+	publishNames(t, ann, "room-event-topic", "ann")
+
+	if _, err := newTestTransport(t, b, "ann").publish("room-event-topic", "", &EventMessage{}); !errors.Is(err, errProducerBusy) {
+		t.Fatalf("publish as a connected producer returns %v, want %v", err, errProducerBusy)
+	}
+	publishNames(t, newTestTransport(t, b, "ann"), "room-other-topic", "ann")
+
+	reader, err := ann.createReader("room-event-topic", earliestPosition)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := reader.next(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.producer != "ann" {
+		t.Fatalf("the producer is %q, want ann", msg.producer)
+	}
+
+	ann.Close()
+	publishNames(t, newTestTransport(t, b, "ann"), "room-event-topic", "ann")
+}
+
+func TestCheckBrokerMessageID(t *testing.T) {
+	tests := []struct {
+		name    string
+		id      []byte
+		wantErr bool
+	}{
+		{name: "offset", id: (&brokerMessage{offset: 3}).received().id},
+		{name: "short", id: []byte{0, 3}, wantErr: true},
+		{name: "out of int", id: []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkBrokerMessageID(tt.id); (err != nil) != tt.wantErr {
+				t.Fatalf("checkBrokerMessageID returns %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
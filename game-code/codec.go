@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/apache/pulsar-client-go/pulsar"
+)
+
+const (
+	jsonCodecName = "json"
+	avroCodecName = "avro"
+)
+
+// a position in avro is y*avroPosStride+x, the codec is the same for the
+// maps of every size
+const avroPosStride = 1024
+
+// codecName chooses the eventCodec, all clients of a room must use the same
+// one, a topic can't change its schema type once it has messages
+var codecName = jsonCodecName
+
+// new fields go to the end with a default, older clients decode the fields
+// they know and ignore the rest of the payload
+const eventAvroSchemaDef = `
+{
+  "type": "record",
+  "name": "EventMessage",
+  "namespace": "game",
+  "fields": [
+    {"name": "type", "type": "string"},
+    {"name": "name", "type": "string", "default": ""},
+    {"name": "avatar", "type": "string", "default": ""},
+    {"name": "comment", "type": "string", "default": ""},
+    {"name": "pos", "type": "int", "default": 0},
+    {"name": "alive", "type": "boolean", "default": false},
+    {"name": "tick", "type": "long", "default": 0},
+    {"name": "list", "type": {"type": "array", "items": "int"}, "default": []},
+    {"name": "obstacles", "type": "bytes", "default": ""},
+    {"name": "version", "type": "int", "default": 0},
+    {"name": "payload", "type": "string", "default": ""}
+  ]
+}
+`
+
+// eventCodec converts EventMessage to the payload of a topic and back,
+// every producer, consumer and reader of a Transport goes through it
+type eventCodec interface {
+	// schema is registered to the topics
+	schema() pulsar.Schema
+	encode(msg *EventMessage) ([]byte, error)
+	decode(payload []byte) (*EventMessage, error)
+}
+
+func newEventCodec() (eventCodec, error) {
+	switch codecName {
+	case jsonCodecName:
+		return &jsonCodec{}, nil
+	case avroCodecName:
+		s, err := pulsar.NewAvroSchemaWithValidation(eventAvroSchemaDef, nil)
+		if err != nil {
+			return nil, err
+		}
+		return &avroCodec{avroSchema: s}, nil
+	}
+	return nil, fmt.Errorf("unknown codec %q, use json or avro", codecName)
+}
+
+// jsonCodec is readable, it's the format of the rooms created before
+type jsonCodec struct{}
+
+func (c *jsonCodec) schema() pulsar.Schema {
+	return pulsar.NewJSONSchema(eventJsonSchemaDef, nil)
+}
+
+func (c *jsonCodec) encode(msg *EventMessage) ([]byte, error) {
+	return json.Marshal(msg)
+}
+
+func (c *jsonCodec) decode(payload []byte) (*EventMessage, error) {
+	msg := &EventMessage{}
+	err := json.Unmarshal(payload, msg)
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// avroCodec is binary, a position is one varint and the obstacle list of
+// a map takes 2 bits for every grid
+type avroCodec struct {
+	avroSchema *pulsar.AvroSchema
+}
+
+func (c *avroCodec) schema() pulsar.Schema {
+	return c.avroSchema
+}
+
+func (c *avroCodec) encode(msg *EventMessage) ([]byte, error) {
+	list := []interface{}{}
+	var obstacles []byte
+	if hasObstacleList(msg.Type) && len(msg.List) > 0 {
+		obstacles = packObstacleList(msg.List)
+	} else {
+		for _, v := range msg.List {
+			list = append(list, int32(v))
+		}
+	}
+	return c.avroSchema.Codec.BinaryFromNative(nil, map[string]interface{}{
+		"type":      msg.Type,
+		"name":      msg.Name,
+		"avatar":    msg.Avatar,
+		"comment":   msg.Comment,
+		"pos":       int32(msg.Y*avroPosStride + msg.X),
+		"alive":     msg.Alive,
+		"tick":      msg.Tick,
+		"list":      list,
+		"obstacles": obstacles,
+		"version":   int32(msg.Version),
+		"payload":   msg.Payload,
+	})
+}
+
+func (c *avroCodec) decode(payload []byte) (*EventMessage, error) {
+	native, _, err := c.avroSchema.Codec.NativeFromBinary(payload)
+	if err != nil {
+		return nil, err
+	}
+	record, ok := native.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected avro record %T", native)
+	}
+	msg := &EventMessage{
+		Type:    record["type"].(string),
+		Name:    record["name"].(string),
+		Avatar:  record["avatar"].(string),
+		Comment: record["comment"].(string),
+		Alive:   record["alive"].(bool),
+		Tick:    record["tick"].(int64),
+		Version: int(record["version"].(int32)),
+		Payload: record["payload"].(string),
+	}
+	pos := int(record["pos"].(int32))
+	msg.X, msg.Y = pos%avroPosStride, pos/avroPosStride
+	for _, v := range record["list"].([]interface{}) {
+		msg.List = append(msg.List, int(v.(int32)))
+	}
+	if obstacles := record["obstacles"].([]byte); len(obstacles) > 0 {
+		msg.List = unpackObstacleList(obstacles)
+	}
+	return msg, nil
+}
+
+// the List of these events is an obstacle list, see genObstacleMapFromList
+func hasObstacleList(eventType string) bool {
+	return eventType == UserJoinEventType || eventType == UpdateObstacleEventType
+}
+
+// packObstacleList packs the obstacle list to 2 bits every grid up to the
+// last obstacle, 0 is empty, destructibleObstacleType or indestructibleObstacleType
+func packObstacleList(list []int) []byte {
+	last := 0
+	for _, code := range list {
+		if code < 0 {
+			code = -code
+		}
+		if code > last {
+			last = code
+		}
+	}
+	grids := make([]byte, ((last+1)*2+7)/8)
+	for _, code := range list {
+		t := indestructibleObstacleType
+		if code < 0 {
+			t = destructibleObstacleType
+			code = -code
+		}
+		grids[code/4] |= byte(t) << (code % 4 * 2)
+	}
+	return grids
+}
+
+func unpackObstacleList(grids []byte) []int {
+	var list []int
+	for code := 0; code < len(grids)*4; code++ {
+		switch ObstacleType(grids[code/4] >> (code % 4 * 2) & 3) {
+		case destructibleObstacleType:
+			list = append(list, -code)
+		case indestructibleObstacleType:
+			list = append(list, code)
+		}
+	}
+	return list
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEventCodecRoundTrip(t *testing.T) {
+	messages := []struct {
+		name string
+		msg  *EventMessage
+		// the obstacles of avro come back in the order of the grids
+		avroList []int
+	}{
+		{
+			name: "move",
+			msg:  &EventMessage{Type: UserMoveEventType, Name: "ann", Avatar: "fff", X: 3, Y: 700, Alive: true, Tick: 123456789},
+		},
+		{
+			name:     "join with obstacles",
+			msg:      &EventMessage{Type: UserJoinEventType, Name: "ann", X: 1, Y: 1, List: []int{7, -2, 5, -1000}},
+			avroList: []int{-2, 5, 7, -1000},
+		},
+		{
+			name: "payload",
+			msg:  &EventMessage{Type: UserDeadEventType, Name: "bob", Version: 2, Payload: encodePayload(&userDeadPayload{Killer: "ann"})},
+		},
+		{
+			name: "empty",
+			msg:  &EventMessage{Type: RoomHostedEventType},
+		},
+	}
+	for _, codec := range []string{jsonCodecName, avroCodecName} {
+		for _, m := range messages {
+			t.Run(codec+"/"+m.name, func(t *testing.T) {
+				last := codecName
+				codecName = codec
+				defer func() { codecName = last }()
+				c, err := newEventCodec()
+				if err != nil {
+					t.Fatal(err)
+				}
+				payload, err := c.encode(m.msg)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := c.decode(payload)
+				if err != nil {
+					t.Fatal(err)
+				}
+				want := *m.msg
+				if codec == avroCodecName && m.avroList != nil {
+					want.List = m.avroList
+				}
+				if !reflect.DeepEqual(got, &want) {
+					t.Fatalf("decoded %+v, want %+v", got, &want)
+				}
+			})
+		}
+	}
+}
+
+func TestNewEventCodecUnknown(t *testing.T) {
+	last := codecName
+	codecName = "xml"
+	defer func() { codecName = last }()
+	if _, err := newEventCodec(); err == nil {
+		t.Fatal("newEventCodec accepts an unknown codec")
+	}
+}
+
+func TestPackObstacleList(t *testing.T) {
+	tests := []struct {
+		name string
+		list []int
+		// the list in the order of the grids
+		want []int
+	}{
+		{name: "empty"},
+		{name: "in order", list: []int{-2, 5, 7}, want: []int{-2, 5, 7}},
+		{name: "out of order", list: []int{9, -4, 0}, want: []int{0, -4, 9}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := unpackObstacleList(packObstacleList(tt.list))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("unpacked %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
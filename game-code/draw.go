@@ -0,0 +1,61 @@
+package main
+
+import (
+	"github.com/hajimehoshi/ebiten/v2"
+	"github.com/hajimehoshi/ebiten/v2/ebitenutil"
+	"image/color"
+	"time"
+)
+
+// drawWorld draws bombs, obstacles, power-ups, players and flames of the
+// world, the players slide by players if it's not nil
+func drawWorld(screen *ebiten.Image, w *World, players *interpolator) {
+	// todo replace Rect with images
+	gridSize := w.settings.GridSize
+	size := float64(gridSize)
+
+	for pos, _ := range w.posToBombs {
+		ebitenutil.DrawCircle(screen, float64(pos.X*gridSize+gridSize/2), float64(pos.Y*gridSize+gridSize/2), size/2, bombColor)
+	}
+
+	for pos, t := range w.obstacleMap {
+		if t == destructibleObstacleType {
+			ebitenutil.DrawRect(screen, float64(pos.X*gridSize), float64(pos.Y*gridSize), size, size, destructibleObstacleColor)
+		} else {
+			ebitenutil.DrawRect(screen, float64(pos.X*gridSize), float64(pos.Y*gridSize), size, size, indestructibleObstacleColor)
+		}
+	}
+
+	for pos, kind := range w.powerUps {
+		ebitenutil.DrawRect(screen, float64(pos.X*gridSize+2), float64(pos.Y*gridSize+2), size-4, size-4, powerUpColor)
+		ebitenutil.DebugPrintAt(screen, powerUpLetters[kind], pos.X*gridSize+gridSize/2-3, pos.Y*gridSize+gridSize/2-8)
+	}
+
+	now := time.Now()
+	for _, player := range w.nameToPlayers {
+		var userColor color.RGBA
+		if player.alive {
+			userColor = playerColor
+		} else {
+			userColor = deadPlayerColor
+		}
+		x, y := float64(player.pos.X), float64(player.pos.Y)
+		if players != nil {
+			x, y = players.pos(w, player, now)
+		}
+		ebitenutil.DrawRect(screen, x*size, y*size, size, size, userColor)
+	}
+
+	for pos, val := range w.flameMap {
+		// draw the flame
+		if val != nil {
+			ebitenutil.DrawLine(screen, float64(pos.X*gridSize), float64(pos.Y*gridSize), float64(pos.X*gridSize+gridSize), float64(pos.Y*gridSize+gridSize), flameColor)
+			ebitenutil.DrawLine(screen, float64(pos.X*gridSize), float64(pos.Y*gridSize+gridSize/2), float64(pos.X*gridSize+gridSize/2), float64(pos.Y*gridSize+gridSize), flameColor)
+			ebitenutil.DrawLine(screen, float64(pos.X*gridSize+gridSize/2), float64(pos.Y*gridSize), float64(pos.X*gridSize+gridSize), float64(pos.Y*gridSize+gridSize/2), flameColor)
+			ebitenutil.DrawLine(screen, float64(pos.X*gridSize), float64(pos.Y*gridSize), float64(pos.X*gridSize+gridSize), float64(pos.Y*gridSize+gridSize), flameColor)
+			ebitenutil.DrawLine(screen, float64(pos.X*gridSize), float64(pos.Y*gridSize+gridSize/2), float64(pos.X*gridSize+gridSize/2), float64(pos.Y*gridSize+gridSize), flameColor)
+			ebitenutil.DrawLine(screen, float64(pos.X*gridSize+gridSize/2), float64(pos.Y*gridSize), float64(pos.X*gridSize+gridSize), float64(pos.Y*gridSize+gridSize/2), flameColor)
+			//ebitenutil.DrawRect(screen, float64(pos.X*gridSize), float64(pos.Y*gridSize), size, size, flameColor)
+		}
+	}
+}
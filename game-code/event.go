@@ -3,7 +3,6 @@ package main
 import (
 	log "github.com/sirupsen/logrus"
 	"strings"
-	"time"
 )
 
 const (
@@ -16,215 +15,308 @@ const (
 	ExplodeEventType        = "ExplodeEvent"
 	UndoExplodeEventType    = "UndoExplodeEvent"
 	UpdateObstacleEventType = "UpdateMapEvent"
+	StateHashEventType      = "StateHashEvent"
+	TakeoverEventType       = "SessionTakeoverEvent"
+	PowerUpSpawnEventType   = "PowerUpSpawnEvent"
+	PowerUpCollectEventType = "PowerUpCollectEvent"
+	RoomHostedEventType     = "RoomHostedEvent"
+	RoomUnhostedEventType   = "RoomUnhostedEvent"
 )
 
-// Event make change on Graph
+// Event make change on World
 type Event interface {
-	handle(game *BombGame)
+	handle(w *World)
+	header() *eventHeader
+}
+
+// eventHeader is carried by every event
+type eventHeader struct {
+	// the logical tick when the event happens, stamped by the sender
+	tick int64
+}
+
+func (h *eventHeader) header() *eventHeader {
+	return h
 }
 
 // UserMoveEvent makes playerInfo move
 type UserMoveEvent struct {
+	eventHeader
 	*playerInfo
 }
 
-func (e *UserMoveEvent) handle(g *BombGame) {
+func (e *UserMoveEvent) handle(w *World) {
 	log.Info("handle UserMoveEvent")
-	if !validCoordinate(e.pos) {
+	if !w.settings.validCoordinate(e.pos) {
 		// move out of boarder
 		return
 	}
 
-	if _, ok := g.obstacleMap[e.pos]; ok {
+	if _, ok := w.obstacleMap[e.pos]; ok {
 		// move to obstacle
 		return
 	}
-	if player, ok := g.nameToPlayers[e.name]; ok && !player.alive {
+	player, ok := w.nameToPlayers[e.name]
+	if ok && !player.alive {
 		// already dead
 		return
 	}
-	g.nameToPlayers[e.name] = e.playerInfo
-	g.posToPlayers[e.pos] = e.playerInfo
+	bomb, onBomb := w.posToBombs[e.pos]
+	if onBomb && ok && player.pos != e.pos && !player.powerUps.Kick {
+		// only a player with kick walks into a bomb
+		return
+	}
+	// the world keeps a copy, the event can be applied again after a rollback
+	moved := *e.playerInfo
+	if ok {
+		w.removePlayerPos(player)
+		// the power-ups stay with the player
+		moved.powerUps = player.powerUps
+	}
+	w.nameToPlayers[e.name] = &moved
+	w.posToPlayers[e.pos] = &moved
+
+	if onBomb && player != nil && distance(player.pos, e.pos) == 1 {
+		// handle push the bomb
+		w.pushBomb(bomb, directionOf(player.pos, e.pos))
+	}
 }
 
 type UserDeadEvent struct {
+	eventHeader
 	*playerInfo
 	killer string
 }
 
-func (e *UserDeadEvent) handle(game *BombGame) {
-	if _, ok := game.nameToPlayers[e.name]; ok {
-		game.nameToPlayers[e.name].alive = false
+func (e *UserDeadEvent) handle(w *World) {
+	if _, ok := w.nameToPlayers[e.name]; ok {
+		w.nameToPlayers[e.name].alive = false
 	}
+	w.settle(e.name)
 }
 
 type UserReviveEvent struct {
+	eventHeader
 	*playerInfo
 }
 
-func (e *UserReviveEvent) handle(game *BombGame) {
-	game.nameToPlayers[e.name] = e.playerInfo
-	game.nameToPlayers[e.name].alive = true
+func (e *UserReviveEvent) handle(w *World) {
+	if player, ok := w.nameToPlayers[e.name]; ok {
+		w.removePlayerPos(player)
+	}
+	revived := *e.playerInfo
+	revived.alive = true
+	w.nameToPlayers[e.name] = &revived
+	w.posToPlayers[e.pos] = &revived
+	w.settle(e.name)
 }
 
 // UserJoinEvent new user join room, must update the map to ensure
 // all player have the consistent start view
 type UserJoinEvent struct {
+	eventHeader
 	*playerInfo
 	Obstacles []int
 }
 
-func (e *UserJoinEvent) handle(game *BombGame) {
+func (e *UserJoinEvent) handle(w *World) {
 	// 1. display the new user on screen
-	game.nameToPlayers[e.name] = e.playerInfo
-	game.posToPlayers[e.pos] = e.playerInfo
+	joined := *e.playerInfo
+	if player, ok := w.nameToPlayers[e.name]; ok {
+		w.removePlayerPos(player)
+		// a player joining again keeps its power-ups
+		joined.powerUps = player.powerUps
+	}
+	w.nameToPlayers[e.name] = &joined
+	w.posToPlayers[e.pos] = &joined
+	w.settle(e.name)
 	// 2. update the obstacle map
-	game.obstacleMap = genObstacleMapFromList(e.Obstacles, nil)
+	w.setObstacles(e.Obstacles)
 }
 
 type SetBombEvent struct {
+	eventHeader
 	bombName string
 	pos      Position
 }
 
-func (e *SetBombEvent) handle(game *BombGame) {
+func (e *SetBombEvent) handle(w *World) {
 	log.Info("handle SetBombEvent")
-	if _, ok := game.obstacleMap[e.pos]; ok {
-		// set on obstacle
+	if _, ok := w.nameToBombs[e.bombName]; ok {
+		return
+	}
+	owner := strings.Split(e.bombName, "-")[0]
+	if player, ok := w.nameToPlayers[owner]; ok && player.pos != e.pos {
+		// players set bombs where they stand, after the moves before it
 		return
 	}
-	bombName := game.setBombWithTrigger(e.bombName, e.pos, make(chan struct{}))
-	if strings.HasPrefix(bombName, "random-") ||
-		strings.HasPrefix(bombName, game.localPlayerName+"-") {
-		// send explode message
-		go func() {
-			// bomb will explode after 2 seconds
-			bombTimer := time.NewTimer(explodeTime * time.Second)
-			<-bombTimer.C
-			game.sendAsync(&ExplodeEvent{
-				bombName: bombName,
-			})
-		}()
+	if !w.canSetBomb(owner, e.pos) {
+		// on an obstacle or a bomb, or too many or too fast
+		return
 	}
+	w.addBombLife(owner, e.bombName)
+	bomb := w.setBomb(e.bombName, e.pos, w.bombLength(owner))
+	// every world explodes the bomb at the same tick
+	w.after(w.settings.explodeTicks(), &worldTimer{
+		kind:     timerExplode,
+		bombName: bomb.bombName,
+	})
 }
 
+// ExplodeEvent is scheduled by the world now, it's only in old recordings
 type ExplodeEvent struct {
+	eventHeader
 	bombName string
 	pos      Position
 }
 
-func (e *ExplodeEvent) handle(game *BombGame) {
+func (e *ExplodeEvent) handle(w *World) {
 	log.Info("handle ExplodeEvent")
-	bomb, ok := game.nameToBombs[e.bombName]
-	if !ok {
-		// bombs are set to the same place will cause this situation
-		return
-	}
-	// async notify, if this bomb is moving, it will stop moving
-	select {
-	case bomb.explodeCh <- struct{}{}:
-	default:
-	}
-
-	bombPos := bomb.pos
-	if _, ok = game.posToBombs[bombPos]; !ok {
-		return
-	}
-	// remove the bomb in the grid
-	game.removeBomb(bomb.bombName)
-	// just mark the exploding bomb position, Draw() will generate the flame
-	game.explodingBombs[bombPos] = bomb
-
-	// explode may destroy obstacles, update obstacleMap
-	game.obstacleLock.Lock()
-	defer game.obstacleLock.Unlock()
-	getExplodeFlame(bombPos, func(p Position) bool {
-		if t, ok := game.obstacleMap[p]; ok {
-			if t == indestructibleObstacleType {
-				return false
-			} else if t == destructibleObstacleType {
-				delete(game.obstacleMap, p)
-			}
-		}
-		return true
-	})
-
-	// update flame map
-	newFlameMap := map[Position]*Bomb{}
-	for bombPos, bomb := range game.explodingBombs {
-		getExplodeFlame(bombPos, func(p Position) bool {
-			if t, ok := game.obstacleMap[p]; ok && t == indestructibleObstacleType {
-				return false
-			}
-			newFlameMap[p] = bomb
-			return true
-		})
-	}
-	game.flameMap = newFlameMap
-
-	if strings.HasPrefix(bomb.bombName, "random-") ||
-		strings.HasPrefix(bomb.bombName, game.localPlayerName+"-") {
-		go func() {
-			// explosion flame will disappear after 2 seconds
-			flameTimer := time.NewTimer(flameTime * time.Second)
-			<-flameTimer.C
-			game.sendAsync(&UndoExplodeEvent{
-				pos: bomb.pos,
-			})
-		}()
-	}
+	w.explode(e.bombName)
 }
 
+// UndoExplodeEvent is scheduled by the world now, it's only in old recordings
 type UndoExplodeEvent struct {
+	eventHeader
 	pos Position
 }
 
-func (e *UndoExplodeEvent) handle(game *BombGame) {
-	delete(game.explodingBombs, e.pos)
-	newFlameMap := map[Position]*Bomb{}
-	for bombPos, bomb := range game.explodingBombs {
-		getExplodeFlame(bombPos, func(p Position) bool {
-			if t, ok := game.obstacleMap[p]; ok && t == indestructibleObstacleType {
-				return false
-			}
-			newFlameMap[p] = bomb
-			return true
-		})
+func (e *UndoExplodeEvent) handle(w *World) {
+	if bomb, ok := w.explodingBombs[e.pos]; ok {
+		w.undoExplode(bomb.bombName)
 	}
-	game.flameMap = newFlameMap
 }
 
+// BombMoveEvent is scheduled by the world now, it's only in old recordings
 type BombMoveEvent struct {
+	eventHeader
 	// bomb playerName, generate by player info
 	bombName string
 	pos      Position
 }
 
-func (e *BombMoveEvent) handle(game *BombGame) {
+func (e *BombMoveEvent) handle(w *World) {
 	log.Info("handle BombMoveEvent")
-	bomb, ok := game.nameToBombs[e.bombName]
-	if !ok {
-		return
-	}
-	_, ok = game.posToBombs[bomb.pos]
+	bomb, ok := w.nameToBombs[e.bombName]
 	if !ok {
 		return
 	}
-	// move this bomb
-	delete(game.posToBombs, bomb.pos)
-	bomb.pos = e.pos
-	game.posToBombs[e.pos] = bomb
+	w.moveBomb(bomb, e.pos)
 }
 
 type UpdateMapEvent struct {
+	eventHeader
 	Obstacles []int
+	// the map file of the room since version 2, nil for a random map
+	gameMap *gameMap
+	// the seed of a random map since version 2, see genObstacleList
+	seed int64
+}
+
+func (e *UpdateMapEvent) handle(w *World) {
+	if e.gameMap != nil {
+		if err := e.gameMap.checkRoom(w.settings); err != nil {
+			log.Warning("[UpdateMapEvent] reject the map:", err)
+			return
+		}
+	}
+	// a new map clears the power-ups
+	w.powerUps = map[Position]powerUpKind{}
+	if e.gameMap == nil {
+		w.obstacleMap = w.settings.genObstacleMapFromList(e.Obstacles, nil)
+		return
+	}
+	w.gameMap = e.gameMap
+	w.setObstacles(e.Obstacles)
+}
+
+// PowerUpSpawnEvent puts a power-up on the ground, the room server or the
+// leader sends it for the power-up cells of the map file
+type PowerUpSpawnEvent struct {
+	eventHeader
+	pos  Position
+	kind powerUpKind
+}
+
+func (e *PowerUpSpawnEvent) handle(w *World) {
+	if _, ok := powerUpLetters[e.kind]; !ok || !w.settings.validCoordinate(e.pos) {
+		return
+	}
+	if _, ok := w.obstacleMap[e.pos]; ok {
+		return
+	}
+	if _, ok := w.powerUps[e.pos]; ok {
+		return
+	}
+	w.powerUps[e.pos] = e.kind
+}
+
+// PowerUpCollectEvent gives the power-up on the grid to the player, it's
+// judged like UserDeadEvent, and the first one in the topic takes it
+type PowerUpCollectEvent struct {
+	eventHeader
+	name string
+	pos  Position
+	kind powerUpKind
 }
 
-func (e *UpdateMapEvent) handle(game *BombGame) {
-	game.obstacleMap = genObstacleMapFromList(e.Obstacles, nil)
+func (e *PowerUpCollectEvent) handle(w *World) {
+	player, ok := w.nameToPlayers[e.name]
+	if !ok || !player.alive || player.pos != e.pos {
+		// the player must stand on it, after the moves before the event
+		return
+	}
+	kind, ok := w.powerUps[e.pos]
+	if !ok || kind != e.kind {
+		// taken by another player
+		return
+	}
+	delete(w.powerUps, e.pos)
+	delete(w.collecting, e.pos)
+	player.powerUps.collect(kind, w.settings)
+}
+
+// StateHashEvent is the hash of the world of a player at a tick, it
+// doesn't change the world, the checker compares the hashes of a room
+type StateHashEvent struct {
+	eventHeader
+	name string
+	hash string
+	// serialized id of the last message applied before the hash
+	messageID []byte
+}
+
+func (e *StateHashEvent) handle(w *World) {}
+
+// SessionTakeoverEvent tells the last session of the player to leave, a
+// new session of the same player on the same machine replaces it
+type SessionTakeoverEvent struct {
+	eventHeader
+	name string
+	// the hash of the token of the last session, the token never leaves the machine
+	tokenHash string
+}
+
+func (e *SessionTakeoverEvent) handle(w *World) {}
+
+// RoomHostedEvent is published to the state topic by a running room
+// server every hostedHeartbeatTime, the score function counts the dead
+// events of the state topic only until hostedLeaseTime after the last one
+type RoomHostedEvent struct {
+	eventHeader
 }
 
-func genObstacleMapFromList(list []int, f func(p Position) bool) map[Position]ObstacleType {
+func (e *RoomHostedEvent) handle(w *World) {}
+
+// RoomUnhostedEvent is published to the state topic when a room server
+// stops, the dead events of the event topic are counted again at once
+type RoomUnhostedEvent struct {
+	eventHeader
+}
+
+func (e *RoomUnhostedEvent) handle(w *World) {}
+
+func (s *roomSettings) genObstacleMapFromList(list []int, f func(p Position) bool) map[Position]ObstacleType {
 	obstacleMap := map[Position]ObstacleType{}
 	for _, code := range list {
 		destructible := false
@@ -233,7 +325,7 @@ func genObstacleMapFromList(list []int, f func(p Position) bool) map[Position]Ob
 			destructible = true
 			code = -code
 		}
-		x, y := decodeXY(code)
+		x, y := s.decodeXY(code)
 		pos := Position{
 			X: x,
 			Y: y,
@@ -250,11 +342,11 @@ func genObstacleMapFromList(list []int, f func(p Position) bool) map[Position]Ob
 	return obstacleMap
 }
 
-func genListFromObstacleMap(obstacleMap map[Position]ObstacleType) []int {
+func (s *roomSettings) genListFromObstacleMap(obstacleMap map[Position]ObstacleType) []int {
 	var list []int
 	for pos, t := range obstacleMap {
-		code := encodeXY(pos.X, pos.Y)
-		if t == destructibleObstacleCount {
+		code := s.encodeXY(pos.X, pos.Y)
+		if t == destructibleObstacleType {
 			code = -code
 		}
 		list = append(list, code)
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"math/rand"
+	"os"
+	"strings"
+)
+
+// the cells of the grid in a map file
+const (
+	emptyCell          = '.'
+	indestructibleCell = '#'
+	destructibleCell   = '+'
+	spawnCell          = 'S'
+	powerUpCell        = 'P'
+)
+
+// loadedMap is loaded from the -map file, the client or server publishes
+// it to the room when joining
+var loadedMap *gameMap
+
+// gameMapFile is the format of a map file, like
+//
+//	name: duel
+//	grid: |
+//	  #######
+//	  #S.+.P#
+//	  #.#.#.#
+//	  #P.+.S#
+//	  #######
+//
+// every row of the grid is as wide as the map, see the cell constants
+type gameMapFile struct {
+	Name string `yaml:"name"`
+	Grid string `yaml:"grid"`
+}
+
+// gameMap is a hand-authored map. The room keeps it once it's published,
+// the map is reset to it instead of a random one, and the players spawn
+// at its spawn points.
+type gameMap struct {
+	Name   string `json:"name"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	// the obstacle list of a Width wide map, see genObstacleMapFromList
+	Obstacles []int      `json:"obstacles"`
+	Spawns    []Position `json:"spawns"`
+	// the cells where power-ups may appear
+	PowerUps []Position `json:"powerUps"`
+}
+
+// loadGameMap reads and validates the map file
+func loadGameMap(path string) (*gameMap, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	file := &gameMapFile{}
+	if err = yaml.Unmarshal(data, file); err != nil {
+		return nil, err
+	}
+	m, err := parseGameMap(file)
+	if err != nil {
+		return nil, fmt.Errorf("invalid map %s: %w", path, err)
+	}
+	if err = m.validate(); err != nil {
+		return nil, fmt.Errorf("invalid map %s: %w", path, err)
+	}
+	return m, nil
+}
+
+func parseGameMap(file *gameMapFile) (*gameMap, error) {
+	rows := strings.Split(strings.TrimSpace(file.Grid), "\n")
+	m := &gameMap{
+		Name:   file.Name,
+		Width:  len(strings.TrimSpace(rows[0])),
+		Height: len(rows),
+	}
+	settings := &roomSettings{Width: m.Width}
+	for y, row := range rows {
+		row = strings.TrimSpace(row)
+		if len(row) != m.Width {
+			return nil, fmt.Errorf("row %d is %d cells wide, the first row is %d", y+1, len(row), m.Width)
+		}
+		for x, cell := range row {
+			pos := Position{X: x, Y: y}
+			switch cell {
+			case emptyCell:
+			case indestructibleCell:
+				m.Obstacles = append(m.Obstacles, settings.encodeXY(x, y))
+			case destructibleCell:
+				// a destructible obstacle is negative, see genObstacleMapFromList
+				m.Obstacles = append(m.Obstacles, -settings.encodeXY(x, y))
+			case spawnCell:
+				m.Spawns = append(m.Spawns, pos)
+			case powerUpCell:
+				m.PowerUps = append(m.PowerUps, pos)
+			default:
+				return nil, fmt.Errorf("unknown cell %q at %d,%d", cell, x, y)
+			}
+		}
+	}
+	return m, nil
+}
+
+// validate checks the size of the map, and that every spawn can reach the
+// others, destructible obstacles can be bombed on the way
+func (m *gameMap) validate() error {
+	if m.Width < minMapGrids || m.Width > maxMapGrids || m.Height < minMapGrids || m.Height > maxMapGrids {
+		return fmt.Errorf("the map must be %d to %d cells wide and high", minMapGrids, maxMapGrids)
+	}
+	if len(m.Spawns) == 0 {
+		return errors.New("the map has no spawn")
+	}
+	settings := m.settings()
+	// a map from the room isn't parsed from a grid
+	for _, pos := range append(append([]Position{}, m.Spawns...), m.PowerUps...) {
+		if !settings.validCoordinate(pos) {
+			return fmt.Errorf("the cell %d,%d is out of the map", pos.X, pos.Y)
+		}
+	}
+	walls := map[Position]bool{}
+	for pos, t := range settings.genObstacleMapFromList(m.Obstacles, nil) {
+		walls[pos] = t == indestructibleObstacleType
+	}
+	reachable := map[Position]bool{m.Spawns[0]: true}
+	queue := []Position{m.Spawns[0]}
+	for len(queue) > 0 {
+		pos := queue[0]
+		queue = queue[1:]
+		for _, dir := range []Direction{dirLeft, dirRight, dirUp, dirDown} {
+			next := settings.getNextPosition(pos, dir)
+			if walls[next] || reachable[next] {
+				continue
+			}
+			reachable[next] = true
+			queue = append(queue, next)
+		}
+	}
+	var unreachable []string
+	for _, pos := range m.Spawns[1:] {
+		if !reachable[pos] {
+			unreachable = append(unreachable, fmt.Sprintf("%d,%d", pos.X, pos.Y))
+		}
+	}
+	if len(unreachable) > 0 {
+		return fmt.Errorf("the spawns %s can't reach the spawn %d,%d",
+			strings.Join(unreachable, " "), m.Spawns[0].X, m.Spawns[0].Y)
+	}
+	return nil
+}
+
+// settings has the size of the map, to decode its obstacle list
+func (m *gameMap) settings() *roomSettings {
+	return &roomSettings{Width: m.Width, Height: m.Height}
+}
+
+// checkRoom returns an error if the map doesn't fit the room
+func (m *gameMap) checkRoom(settings *roomSettings) error {
+	if m.Width != settings.Width || m.Height != settings.Height {
+		return fmt.Errorf("the map %s is %dx%d, but the room is %dx%d",
+			m.Name, m.Width, m.Height, settings.Width, settings.Height)
+	}
+	return nil
+}
+
+// pickSpawn returns a random spawn without a player, or a free grid like
+// joinPos if all of them have players
+func (m *gameMap) pickSpawn(w *World) Position {
+	var free []Position
+	for _, pos := range m.Spawns {
+		if _, ok := w.posToPlayers[pos]; !ok {
+			free = append(free, pos)
+		}
+	}
+	if len(free) == 0 {
+		if len(m.Spawns) == 0 {
+			return w.joinPos(Position{})
+		}
+		return w.joinPos(m.Spawns[0])
+	}
+	return free[rand.Intn(len(free))]
+}
+
+// updateEvent resets the map of the room to the map
+func (m *gameMap) updateEvent() *UpdateMapEvent {
+	return &UpdateMapEvent{
+		Obstacles: m.Obstacles,
+		gameMap:   m,
+	}
+}
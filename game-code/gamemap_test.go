@@ -0,0 +1,295 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestGameMapValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		grid string
+		// a part of the error, empty if the map is valid
+		wantErr string
+	}{
+		{
+			name: "valid",
+			grid: `
+				S.+.S
+				.#.#.
+				..P..
+				.#.#.
+				S...S`,
+		},
+		{
+			name: "spawns behind destructible obstacles",
+			grid: `
+				S.+..
+				.#+##
+				++###
+				.....
+				####S`,
+		},
+		{
+			name: "rows of different widths",
+			grid: `
+				S....
+				.....
+				....
+				.....
+				....S`,
+			wantErr: "row 3 is 4 cells wide",
+		},
+		{
+			name: "unknown cell",
+			grid: `
+				S....
+				..x..
+				.....
+				.....
+				....S`,
+			wantErr: "unknown cell 'x' at 2,1",
+		},
+		{
+			name: "too small",
+			grid: `
+				S...
+				....
+				....
+				...S`,
+			wantErr: "the map must be",
+		},
+		{
+			name: "no spawn",
+			grid: `
+				.....
+				.....
+				.....
+				.....
+				.....`,
+			wantErr: "the map has no spawn",
+		},
+		{
+			name: "walled in spawn",
+			grid: `
+				S....
+				.....
+				...##
+				...#S
+				...##`,
+			wantErr: "the spawns 4,3 can't reach the spawn 0,0",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := parseGameMap(&gameMapFile{Name: tt.name, Grid: tt.grid})
+			if err == nil {
+				err = m.validate()
+			}
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("invalid map: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseGameMap(t *testing.T) {
+	m, err := parseGameMap(&gameMapFile{Name: "cells", Grid: `
+		S#+P.
+		.....
+		.....
+		.....
+		....S`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Width != 5 || m.Height != 5 {
+		t.Fatalf("the map is %dx%d, want 5x5", m.Width, m.Height)
+	}
+	obstacles := m.settings().genObstacleMapFromList(m.Obstacles, nil)
+	want := map[Position]ObstacleType{
+		{X: 1, Y: 0}: indestructibleObstacleType,
+		{X: 2, Y: 0}: destructibleObstacleType,
+	}
+	if !equalObstacles(obstacles, want) {
+		t.Fatalf("obstacles %v, want %v", obstacles, want)
+	}
+	if len(m.Spawns) != 2 || m.Spawns[0] != (Position{X: 0, Y: 0}) || m.Spawns[1] != (Position{X: 4, Y: 4}) {
+		t.Fatalf("spawns %v, want [{0 0} {4 4}]", m.Spawns)
+	}
+	if len(m.PowerUps) != 1 || m.PowerUps[0] != (Position{X: 3, Y: 0}) {
+		t.Fatalf("power-up cells %v, want [{3 0}]", m.PowerUps)
+	}
+}
+
+func TestGameMapCheckRoom(t *testing.T) {
+	m, err := loadGameMap("maps/duel.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name          string
+		width, height int
+		wantErr       bool
+	}{
+		{name: "as large as the map", width: m.Width, height: m.Height},
+		{name: "wider", width: m.Width + 1, height: m.Height, wantErr: true},
+		{name: "higher", width: m.Width, height: m.Height + 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settings := defaultRoomSettings()
+			settings.Width, settings.Height = tt.width, tt.height
+			if err := m.checkRoom(settings); (err != nil) != tt.wantErr {
+				t.Fatalf("checkRoom returns %v, want an error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func equalObstacles(a, b map[Position]ObstacleType) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for pos, t := range a {
+		if other, ok := b[pos]; !ok || other != t {
+			return false
+		}
+	}
+	return true
+}
+
+func TestReadRoomSettingsMap(t *testing.T) {
+	duel, err := loadGameMap("maps/duel.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wider := *duel
+	wider.Name, wider.Width = "wider", duel.Width+1
+	noSpawn := *duel
+	noSpawn.Name, noSpawn.Spawns = "no spawn", nil
+	outside := *duel
+	outside.Name, outside.Spawns = "outside", append([]Position{{X: -1, Y: 3}}, duel.Spawns...)
+	tests := []struct {
+		name string
+		// the maps published before and after the settings
+		before, after []*gameMap
+		// the name of the map read, "" for none
+		want string
+	}{
+		{name: "none"},
+		{name: "fits the room", after: []*gameMap{duel}, want: "duel"},
+		{name: "another size", after: []*gameMap{&wider}},
+		{name: "no spawn", after: []*gameMap{&noSpawn}},
+		{name: "spawn out of the map", after: []*gameMap{&outside}},
+		{name: "keeps the last valid one", after: []*gameMap{duel, &wider, &noSpawn}, want: "duel"},
+		{name: "before the settings", before: []*gameMap{duel}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := newTestTransport(t, newMemoryBroker(), "")
+			for _, m := range tt.before {
+				if err := publishRoomMap(transport, "room", m); err != nil {
+					t.Fatal(err)
+				}
+			}
+			settings := defaultRoomSettings()
+			settings.Width, settings.Height = duel.Width, duel.Height
+			_, err := transport.publish(getRoomConfigTopicName("room"), "", &EventMessage{
+				Type:    RoomConfigType,
+				Name:    "room",
+				Payload: encodePayload(settings),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, m := range tt.after {
+				if err := publishRoomMap(transport, "room", m); err != nil {
+					t.Fatal(err)
+				}
+			}
+			_, roomMap, err := readRoomSettings(transport, "room")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got string
+			if roomMap != nil {
+				got = roomMap.Name
+			}
+			if got != tt.want {
+				t.Fatalf("read the map %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpdateMapEventChecksMap(t *testing.T) {
+	duel, err := loadGameMap("maps/duel.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	noSpawn := *duel
+	noSpawn.Spawns = nil
+	if _, err := convertMsgToEvent(convertEventToMsg(noSpawn.updateEvent())); err == nil {
+		t.Fatal("the map without spawns is decoded")
+	}
+
+	// the room is larger than the map
+	w := newWorld("", roleObserver, defaultRoomSettings())
+	event, err := convertMsgToEvent(convertEventToMsg(duel.updateEvent()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Apply(event)
+	if w.gameMap != nil || len(w.obstacleMap) != 0 {
+		t.Fatal("the map of another size is applied")
+	}
+}
+
+func TestPickSpawn(t *testing.T) {
+	duel, err := loadGameMap("maps/duel.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	noSpawn := *duel
+	noSpawn.Spawns = nil
+	tests := []struct {
+		name string
+		m    *gameMap
+		// the spawns with players
+		taken []Position
+		// pickSpawn returns one of the spawns, or a free grid if nil
+		want []Position
+	}{
+		{name: "free spawn", m: duel, taken: duel.Spawns[1:], want: duel.Spawns[:1]},
+		{name: "every spawn taken", m: duel, taken: duel.Spawns},
+		{name: "no spawn", m: &noSpawn},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settings := defaultRoomSettings()
+			settings.Width, settings.Height = duel.Width, duel.Height
+			w := newWorld("", roleObserver, settings)
+			w.Apply(duel.updateEvent())
+			for i, pos := range tt.taken {
+				player := &playerInfo{name: fmt.Sprintf("p%d", i), pos: pos, alive: true}
+				w.nameToPlayers[player.name] = player
+				w.posToPlayers[pos] = player
+			}
+			got := tt.m.pickSpawn(w)
+			if tt.want != nil {
+				if got != tt.want[0] {
+					t.Fatalf("picked %v, want %v", got, tt.want[0])
+				}
+				return
+			}
+			if w.joinPos(got) != got {
+				t.Fatalf("picked %v, which isn't free", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// LeaderEventType is the type of the messages in the control topic, it's
+// not an Event, the leader and its term are in Name and Payload
+const LeaderEventType = "LeaderHeartbeat"
+
+const (
+	// the leader sends a heartbeat every leaderHeartbeatTime
+	leaderHeartbeatTime = time.Second
+	// the lease of the leader expires leaderLeaseTime after its last heartbeat
+	leaderLeaseTime = 3 * leaderHeartbeatTime
+)
+
+// leaderPayload is a claim or a heartbeat of the leader of a term, the
+// leader resigns with Resign
+type leaderPayload struct {
+	Term   int64 `json:"term"`
+	Resign bool  `json:"resign"`
+}
+
+// leaderElector elects one client of a room to do the room-wide duties,
+// like updating the map and publishing snapshots. The control topic of the
+// room is the log of the election: the leader sends heartbeats, and when
+// its lease expires, the candidates claim the next term, the first claim
+// of a term in the topic wins. A leader that hangs loses the lease, and
+// steps down when it reads the newer term. The heartbeats are sent while
+// the loop doing the duties calls served, so a leader whose game loop
+// hangs loses the lease too.
+type leaderElector struct {
+	roomName  string
+	candidate string
+
+	lock sync.Mutex
+	// the latest term and its leader, "" if the leader resigned
+	term   int64
+	leader string
+	// when the lease of the leader expires, it's extended by every heartbeat
+	expiry time.Time
+	// when the duty loop called served last
+	servedAt time.Time
+
+	closeCh chan struct{}
+	// closed when run returns
+	doneCh chan struct{}
+}
+
+func newLeaderElector(roomName, candidate string) *leaderElector {
+	e := &leaderElector{
+		roomName:  roomName,
+		candidate: candidate,
+		servedAt:  time.Now(),
+		closeCh:   make(chan struct{}),
+		doneCh:    make(chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+func (e *leaderElector) getControlTopicName() string {
+	return e.roomName + "-control-topic"
+}
+
+// isLeader returns true if the candidate holds an unexpired lease
+func (e *leaderElector) isLeader() bool {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.leader == e.candidate && time.Now().Before(e.expiry)
+}
+
+// served tells that the loop doing the duties of the leader is running, it
+// should be called every time the loop runs
+func (e *leaderElector) served() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.servedAt = time.Now()
+}
+
+// getLeader returns the leader with an unexpired lease, or ""
+func (e *leaderElector) getLeader() string {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if time.Now().After(e.expiry) {
+		return ""
+	}
+	return e.leader
+}
+
+// Close hands over, the leader resigns so another candidate claims at once
+func (e *leaderElector) Close() {
+	close(e.closeCh)
+	<-e.doneCh
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.leader = ""
+	e.expiry = time.Time{}
+}
+
+// run follows the control topic, and reconnects with backoff when it breaks
+func (e *leaderElector) run() {
+	defer close(e.doneCh)
+	backoff := minReconnectBackoff
+	for {
+		err := e.follow(func() {
+			backoff = minReconnectBackoff
+		})
+		if err == nil {
+			return
+		}
+		e.lock.Lock()
+		// it can't know whether its lease is extended
+		e.expiry = time.Time{}
+		e.lock.Unlock()
+		log.Warningf("[leaderElector] %v, retry in %v", err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-e.closeCh:
+			return
+		}
+		backoff *= 2
+		if backoff > maxReconnectBackoff {
+			backoff = maxReconnectBackoff
+		}
+	}
+}
+
+// follow reads the control topic from its latest message, and heartbeats
+// or claims every leaderHeartbeatTime. It returns nil after Close.
+func (e *leaderElector) follow(connected func()) error {
+	transport, err := newTransport("")
+	if err != nil {
+		return err
+	}
+	defer transport.Close()
+	reader, err := transport.createReader(e.getControlTopicName(), latestPosition)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	connected()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	receiveCh := make(chan *receivedMessage)
+	errCh := make(chan error, 1)
+	go func() {
+		for {
+			msg, err := reader.next(ctx)
+			if err != nil {
+				errCh <- err
+				return
+			}
+			select {
+			case receiveCh <- msg:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(leaderHeartbeatTime)
+	defer ticker.Stop()
+	for {
+		select {
+		case msg := <-receiveCh:
+			e.apply(msg.event)
+		case err := <-errCh:
+			return err
+		case <-ticker.C:
+			if err := e.heartbeat(transport); err != nil {
+				return err
+			}
+		case <-e.closeCh:
+			e.resign(transport)
+			return nil
+		}
+	}
+}
+
+// apply follows a claim or a heartbeat in the control topic
+func (e *leaderElector) apply(msg *EventMessage) {
+	if msg.Type != LeaderEventType {
+		return
+	}
+	payload := &leaderPayload{}
+	if err := json.Unmarshal([]byte(msg.Payload), payload); err != nil {
+		log.Error("[leaderElector]", err)
+		return
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if payload.Term < e.term || (payload.Term == e.term && msg.Name != e.leader) {
+		// a stale leader, or a claim which is too late
+		return
+	}
+	if payload.Term > e.term {
+		if e.leader == e.candidate || msg.Name == e.candidate {
+			log.Infof("[leaderElector] %s is the leader of %s, term %d", msg.Name, e.roomName, payload.Term)
+		}
+		e.term = payload.Term
+		e.leader = msg.Name
+	}
+	if payload.Resign {
+		e.leader = ""
+		e.expiry = time.Time{}
+		return
+	}
+	e.expiry = time.Now().Add(leaderLeaseTime)
+}
+
+// heartbeat extends the lease of the leader, or claims the next term
+// when the lease expired. It does neither while the duty loop hangs.
+func (e *leaderElector) heartbeat(transport Transport) error {
+	e.lock.Lock()
+	term := e.term
+	switch {
+	case time.Since(e.servedAt) > leaderHeartbeatTime:
+		// let the lease expire, another candidate does the duties
+		e.lock.Unlock()
+		return nil
+	case e.leader == e.candidate:
+		// keep the term even if the lease expired, a newer term wins anyway
+	case time.Now().After(e.expiry):
+		term++
+	default:
+		e.lock.Unlock()
+		return nil
+	}
+	e.lock.Unlock()
+	return e.publish(transport, &leaderPayload{Term: term})
+}
+
+// resign hands over the room if the candidate is the leader
+func (e *leaderElector) resign(transport Transport) {
+	e.lock.Lock()
+	leader, term := e.leader == e.candidate, e.term
+	e.lock.Unlock()
+	if !leader {
+		return
+	}
+	if err := e.publish(transport, &leaderPayload{Term: term, Resign: true}); err != nil {
+		log.Warning("[leaderElector] resign failed, the lease will expire:", err)
+	}
+}
+
+func (e *leaderElector) publish(transport Transport, payload *leaderPayload) error {
+	_, err := transport.publish(e.getControlTopicName(), "", &EventMessage{
+		Type:    LeaderEventType,
+		Name:    e.candidate,
+		Payload: encodePayload(payload),
+	})
+	if err != nil {
+		return fmt.Errorf("publish to control topic: %w", err)
+	}
+	return nil
+}
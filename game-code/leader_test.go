@@ -0,0 +1,141 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLeaderElectorApply(t *testing.T) {
+	heartbeat := func(name string, term int64) *EventMessage {
+		return &EventMessage{Type: LeaderEventType, Name: name, Payload: encodePayload(&leaderPayload{Term: term})}
+	}
+	resign := func(name string, term int64) *EventMessage {
+		return &EventMessage{Type: LeaderEventType, Name: name, Payload: encodePayload(&leaderPayload{Term: term, Resign: true})}
+	}
+	tests := []struct {
+		name     string
+		messages []*EventMessage
+		// the leader with a lease after the messages, "" for none
+		want     string
+		wantTerm int64
+	}{
+		{name: "none"},
+		{name: "claim", messages: []*EventMessage{heartbeat("ann", 1)}, want: "ann", wantTerm: 1},
+		{
+			name:     "the first claim of a term wins",
+			messages: []*EventMessage{heartbeat("ann", 1), heartbeat("bob", 1), heartbeat("ann", 1)},
+			want:     "ann",
+			wantTerm: 1,
+		},
+		{
+			name:     "a newer term wins",
+			messages: []*EventMessage{heartbeat("ann", 1), heartbeat("bob", 2)},
+			want:     "bob",
+			wantTerm: 2,
+		},
+		{
+			name:     "a stale leader",
+			messages: []*EventMessage{heartbeat("ann", 1), heartbeat("bob", 2), heartbeat("ann", 1)},
+			want:     "bob",
+			wantTerm: 2,
+		},
+		{name: "resign", messages: []*EventMessage{heartbeat("ann", 1), resign("ann", 1)}, wantTerm: 1},
+		{
+			name:     "resign of another leader",
+			messages: []*EventMessage{heartbeat("ann", 1), resign("bob", 1)},
+			want:     "ann",
+			wantTerm: 1,
+		},
+		{name: "another type", messages: []*EventMessage{{Type: UserMoveEventType, Name: "ann"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &leaderElector{roomName: "room", candidate: "ann"}
+			for _, msg := range tt.messages {
+				e.apply(msg)
+			}
+			if got := e.getLeader(); got != tt.want {
+				t.Fatalf("the leader is %q, want %q", got, tt.want)
+			}
+			if e.term != tt.wantTerm {
+				t.Fatalf("term %d, want %d", e.term, tt.wantTerm)
+			}
+			if e.isLeader() != (tt.want == "ann") {
+				t.Fatalf("ann is the leader %v, want %v", e.isLeader(), tt.want == "ann")
+			}
+		})
+	}
+}
+
+func TestLeaderElectorLeaseExpires(t *testing.T) {
+	e := &leaderElector{roomName: "room", candidate: "ann"}
+	e.apply(&EventMessage{Type: LeaderEventType, Name: "ann", Payload: encodePayload(&leaderPayload{Term: 1})})
+	e.expiry = time.Now().Add(-time.Millisecond)
+	if e.isLeader() || e.getLeader() != "" {
+		t.Fatal("the expired lease still holds")
+	}
+}
+
+// waitLeader waits until every elector follows the same leader, or the
+// wanted one if it isn't ""
+func waitLeader(t *testing.T, want string, electors ...*leaderElector) string {
+	t.Helper()
+	deadline := time.Now().Add(3 * leaderLeaseTime)
+	for time.Now().Before(deadline) {
+		leader := electors[0].getLeader()
+		agreed := leader != "" && (want == "" || leader == want)
+		for _, e := range electors[1:] {
+			agreed = agreed && e.getLeader() == leader
+		}
+		if agreed {
+			return leader
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("no leader is elected, want %q", want)
+	return ""
+}
+
+func TestLeaderElectorHandsOver(t *testing.T) {
+	last := transportName
+	transportName = memoryTransportName
+	defer func() { transportName = last }()
+
+	roomName := "leader-test-" + randStringRunes(8)
+	electors := map[string]*leaderElector{
+		"ann": newLeaderElector(roomName, "ann"),
+		"bob": newLeaderElector(roomName, "bob"),
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		// the duty loops of both
+		for {
+			select {
+			case <-time.After(100 * time.Millisecond):
+			case <-stop:
+				return
+			}
+			for _, e := range electors {
+				e.served()
+			}
+		}
+	}()
+
+	leader := waitLeader(t, "", electors["ann"], electors["bob"])
+	other := "bob"
+	if leader == "bob" {
+		other = "ann"
+	}
+	if !electors[leader].isLeader() || electors[other].isLeader() {
+		t.Fatalf("%s and %s are both the leader", leader, other)
+	}
+	// the other claims at once instead of waiting for the lease
+	resigned := time.Now()
+	electors[leader].Close()
+	waitLeader(t, other, electors[other])
+	if time.Since(resigned) >= leaderLeaseTime {
+		t.Fatalf("%s waited for the lease after %s resigned", other, leader)
+	}
+	electors[other].Close()
+}
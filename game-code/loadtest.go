@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// the load test reports every loadReportTime second
+	loadReportTime = 10
+	// after the bots stop, the rooms settle for the last bombs and flames
+	// and loadSettleTime more
+	loadSettleTime = time.Second
+)
+
+// loadTest runs bots in many rooms of the same broker, and reports the
+// traffic of the clients and whether the clients of a room agree
+type loadTest struct {
+	roomPrefix    string
+	rooms         int
+	botsPerRoom   int
+	duration      time.Duration
+	strategy      string
+	authoritative bool
+
+	// room name to its bots
+	roomBots map[string][]*bot
+	servers  []*roomServer
+}
+
+// the rooms are named roomPrefix with a number, a random prefix if it's empty
+func runLoadTest(roomPrefix string, rooms, botsPerRoom int, duration time.Duration, strategy string, authoritative bool, stopCh chan struct{}) error {
+	if roomPrefix == "" {
+		// the rooms of every run are new
+		roomPrefix = "loadtest" + randStringRunes(4) + "-room"
+	}
+	t := &loadTest{
+		roomPrefix:    roomPrefix,
+		rooms:         rooms,
+		botsPerRoom:   botsPerRoom,
+		duration:      duration,
+		strategy:      strategy,
+		authoritative: authoritative,
+		roomBots:      map[string][]*bot{},
+	}
+	defer t.Close()
+	err := t.start()
+	if err != nil {
+		return err
+	}
+
+	total := &clientStats{}
+	begin := time.Now()
+	last := begin
+	ticker := time.NewTicker(time.Second * loadReportTime)
+	defer ticker.Stop()
+	timeout := time.After(duration)
+	for running := true; running; {
+		select {
+		case <-ticker.C:
+		case <-timeout:
+			running = false
+		case <-stopCh:
+			running = false
+		}
+		now := time.Now()
+		period := t.takeStats()
+		log.Infof("[loadTest] %v: %s, %.0f events/s", now.Sub(begin).Round(time.Second),
+			period, float64(period.received)/now.Sub(last).Seconds())
+		period.take(total)
+		last = now
+	}
+
+	t.settle()
+	t.takeStats().take(total)
+	fmt.Printf("load test of %d rooms with %d bots in %v\n", t.rooms, t.botsPerRoom, time.Since(begin).Round(time.Second))
+	fmt.Println(total)
+	fmt.Print(t.divergence())
+	return nil
+}
+
+// start joins the bots, and the room servers if authoritative
+func (t *loadTest) start() error {
+	for i := 0; i < t.rooms; i++ {
+		roomName := fmt.Sprintf("%s%d", t.roomPrefix, i)
+		if t.authoritative {
+			server, err := newRoomServer(roomName)
+			if err != nil {
+				return err
+			}
+			t.servers = append(t.servers, server)
+			go server.run()
+		}
+		for j := 0; j < t.botsPerRoom; j++ {
+			b, err := newBot(fmt.Sprintf("bot%d", j), roomName, t.authoritative, t.strategy)
+			if err != nil {
+				return err
+			}
+			t.roomBots[roomName] = append(t.roomBots[roomName], b)
+			go b.run()
+		}
+	}
+	log.Infof("[loadTest] %d rooms with %d bots started", t.rooms, t.botsPerRoom)
+	return nil
+}
+
+// takeStats sums and resets the stats of all bots
+func (t *loadTest) takeStats() *clientStats {
+	stats := &clientStats{}
+	for _, bots := range t.roomBots {
+		for _, b := range bots {
+			b.client.stats.take(stats)
+		}
+	}
+	return stats
+}
+
+// settle stops the bots, and keeps receiving until the events in flight
+// arrive and the bombs are gone
+func (t *loadTest) settle() {
+	for _, bots := range t.roomBots {
+		for _, b := range bots {
+			b.stop()
+		}
+	}
+	settleTime := loadSettleTime
+	for _, bots := range t.roomBots {
+		for _, b := range bots {
+			if d := b.world.settings.ExplodeTime + b.world.settings.FlameTime + loadSettleTime; d > settleTime {
+				settleTime = d
+			}
+		}
+	}
+	deadline := time.Now().Add(settleTime)
+	for time.Now().Before(deadline) {
+		for _, bots := range t.roomBots {
+			for _, b := range bots {
+				b.step()
+			}
+		}
+		time.Sleep(time.Second / ticksPerSecond)
+	}
+}
+
+// divergence groups the bots of every room by their worlds, the bots of a
+// room should be in one group
+func (t *loadTest) divergence() string {
+	var roomNames []string
+	for roomName := range t.roomBots {
+		roomNames = append(roomNames, roomName)
+	}
+	sort.Strings(roomNames)
+
+	report := strings.Builder{}
+	diverged := 0
+	for _, roomName := range roomNames {
+		var states []*worldSnapshot
+		groups := map[string][]string{}
+		var keys []string
+		for _, b := range t.roomBots[roomName] {
+			s := b.world.snapshot()
+			// the clocks of bots are a bit different
+			s.Tick = 0
+			data, _ := json.Marshal(s)
+			key := string(data)
+			if _, ok := groups[key]; !ok {
+				keys = append(keys, key)
+				states = append(states, s)
+			}
+			groups[key] = append(groups[key], b.world.localPlayerName)
+		}
+		if len(keys) <= 1 {
+			continue
+		}
+		diverged++
+		report.WriteString(fmt.Sprintf("%s diverged in %s:", roomName, strings.Join(snapshotDiff(states), ", ")))
+		for _, key := range keys {
+			report.WriteString(fmt.Sprintf(" %v", groups[key]))
+		}
+		report.WriteString("\n")
+	}
+	report.WriteString(fmt.Sprintf("%d of %d rooms diverged\n", diverged, len(roomNames)))
+	return report.String()
+}
+
+// snapshotDiff returns the fields of worldSnapshot which are not the same in states
+func snapshotDiff(states []*worldSnapshot) []string {
+	var fields []string
+	v := reflect.ValueOf(*states[0])
+	for i := 0; i < v.NumField(); i++ {
+		for _, s := range states[1:] {
+			if !reflect.DeepEqual(v.Field(i).Interface(), reflect.ValueOf(*s).Field(i).Interface()) {
+				fields = append(fields, v.Type().Field(i).Name)
+				break
+			}
+		}
+	}
+	return fields
+}
+
+func (t *loadTest) Close() {
+	for _, bots := range t.roomBots {
+		for _, b := range bots {
+			b.Close()
+		}
+	}
+	for _, server := range t.servers {
+		server.Close()
+	}
+}
@@ -7,6 +7,9 @@ import (
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v3"
 	"os"
+	"os/signal"
+	"strings"
+	"time"
 )
 
 var pulsarConfig *PulsarConfig
@@ -27,12 +30,16 @@ func parseConfigFile(path string) *PulsarConfig {
 	if config.BrokerUrl == "" {
 		config.BrokerUrl = "pulsar://localhost:6650"
 	}
+	if config.Codec == "" {
+		config.Codec = jsonCodecName
+	}
 
 	fmt.Println("Broker url:", config.BrokerUrl)
 	fmt.Println("OAuth.Enabled:", config.OAuth.Enabled)
 	fmt.Println("OAuth.IssuerURL:", config.OAuth.IssuerURL)
 	fmt.Println("OAuth.Audience:", config.OAuth.Audience)
 	fmt.Println("OAuth.PrivateKey:", config.OAuth.PrivateKey)
+	fmt.Println("Codec:", config.Codec)
 	return &config
 }
 
@@ -46,6 +53,10 @@ type OAuthConfig struct {
 type PulsarConfig struct {
 	BrokerUrl string      `yaml:"brokerUrl"`
 	OAuth     OAuthConfig `yaml:"OAuth"`
+	// json or avro
+	Codec string `yaml:"codec"`
+	// the settings of rooms by name, see getRoomSettings
+	Rooms map[string]yaml.Node `yaml:"rooms"`
 }
 
 func main() {
@@ -54,14 +65,30 @@ func main() {
 	var playerName string
 	var mode string
 	var at string
+	var authoritative bool
+	var strategy string
+	var bots int
+	var rooms int
+	var duration time.Duration
+	var mapPath string
+	var seed int64
 
 	pulsarConfig = parseConfigFile("config.yml")
 
 	// Bind the flag
 	flag.StringVar(&roomName, "room", "", "the room name")
 	flag.StringVar(&playerName, "player", "", "the player name")
-	flag.StringVar(&mode, "mode", "play", "play/watch")
-	flag.StringVar(&at, "at", "earliest", "specify the point you'd like to watch")
+	flag.StringVar(&mode, "mode", "play", "play/watch/server/bot/loadtest/check/map")
+	flag.StringVar(&at, "at", "earliest", "specify the point you'd like to watch: earliest, latest, RFC3339 time, -5m or message id")
+	flag.BoolVar(&authoritative, "authoritative", false, "the room is hosted by a -mode server, play or watch its accepted events")
+	flag.StringVar(&transportName, "transport", pulsarTransportName, "pulsar/memory, memory runs the room in process without a broker")
+	flag.StringVar(&strategy, "strategy", "careful", "the strategy of -mode bot: "+strings.Join(botStrategyNames(), "/"))
+	flag.IntVar(&bots, "bots", 1, "the number of bots of -mode bot, or in every room of -mode loadtest, the bots are named -player with a number")
+	flag.IntVar(&rooms, "rooms", 10, "the number of rooms of -mode loadtest, the rooms are named -room with a number")
+	flag.DurationVar(&duration, "duration", time.Minute, "how long -mode loadtest runs")
+	flag.StringVar(&mapPath, "map", "", "a map file, the room of play, bot or server plays it instead of random maps, see maps/duel.yml")
+	flag.Int64Var(&seed, "seed", 0, "the seed of the random map printed by -mode map, 0 is a new one")
+	flag.StringVar(&codecName, "codec", pulsarConfig.Codec, "json/avro, the encoding of events, overrides codec in config.yml")
 	// Parse the flag
 	flag.Parse()
 
@@ -74,30 +101,120 @@ func main() {
 		log.Fatal("must specify the -mode")
 		os.Exit(1)
 	}
+	if mapPath != "" {
+		var err error
+		loadedMap, err = loadGameMap(mapPath)
+		if err != nil {
+			log.Fatal("[main]", err)
+		}
+	}
 	if playerName == "" && mode == "play" {
 		log.Fatal("playerName must not be empty")
 		os.Exit(1)
 	}
+	if mode == "map" {
+		if loadedMap != nil {
+			fmt.Printf("the map %s is %dx%d with %d spawns\n", loadedMap.Name, loadedMap.Width, loadedMap.Height, len(loadedMap.Spawns))
+			return
+		}
+		// print a random map of the room settings in config.yml
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		if err := printRandomMap(roomName, seed); err != nil {
+			log.Fatal("[main]", err)
+		}
+		return
+	}
+	if mode == "loadtest" {
+		// stop the load test by Ctrl+C, it still reports
+		interrupt := make(chan os.Signal, 1)
+		signal.Notify(interrupt, os.Interrupt)
+		stopCh := make(chan struct{})
+		go func() {
+			<-interrupt
+			close(stopCh)
+		}()
+		err := runLoadTest(roomName, rooms, bots, duration, strategy, authoritative, stopCh)
+		if err != nil {
+			log.Fatal("[main]", err)
+		}
+		return
+	}
 	if roomName == "" {
 		log.Fatal("roomName must not be empty")
 		os.Exit(1)
 	}
 
-	ebiten.SetWindowSize(screenWidth, screenHeight)
+	if mode == "bot" {
+		// stop the bots by Ctrl+C
+		interrupt := make(chan os.Signal, 1)
+		signal.Notify(interrupt, os.Interrupt)
+		stopCh := make(chan struct{})
+		go func() {
+			<-interrupt
+			close(stopCh)
+		}()
+		err := runBots(playerName, roomName, authoritative, strategy, bots, stopCh)
+		if err != nil {
+			log.Fatal("[main]", err)
+		}
+		return
+	}
+
+	if mode == "check" {
+		// stop following the room by Ctrl+C
+		interrupt := make(chan os.Signal, 1)
+		signal.Notify(interrupt, os.Interrupt)
+		stopCh := make(chan struct{})
+		go func() {
+			<-interrupt
+			close(stopCh)
+		}()
+		err := runStateCheck(roomName, at, authoritative, stopCh)
+		if err != nil {
+			log.Fatal("[main]", err)
+		}
+		return
+	}
+
+	if mode == "server" {
+		server, err := newRoomServer(roomName)
+		if err != nil {
+			log.Fatal("[main]", err)
+		}
+		// stop the server by Ctrl+C
+		interrupt := make(chan os.Signal, 1)
+		signal.Notify(interrupt, os.Interrupt)
+		go func() {
+			<-interrupt
+			server.Close()
+		}()
+		log.Info("room server is running: ", roomName)
+		server.run()
+		return
+	}
+
 	if mode == "play" {
-		game := newGame(playerName, roomName)
+		game, err := newGame(playerName, roomName, authoritative)
+		if err != nil {
+			log.Fatal("[main]", err)
+		}
 		defer game.Close()
 		if err := ebiten.RunGame(game); err != nil {
 			log.Fatal("[main]", err)
 		}
 	} else if mode == "watch" {
-		replay := NewGameReplay(roomName, at)
+		replay, err := NewGameReplay(roomName, at, authoritative)
+		if err != nil {
+			log.Fatal("[main]", err)
+		}
 		defer replay.Close()
 		if err := ebiten.RunGame(replay); err != nil {
 			log.Fatal("[main]", err)
 		}
 	} else {
-		log.Fatal("mode must be play or watch")
+		log.Fatal("mode must be play, watch, server, bot, loadtest, check or map")
 		os.Exit(1)
 	}
 }
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"math/rand"
+	"strings"
+)
+
+// the symmetry modes of the random maps, the players spawning at the
+// mirrored grids face the same map
+const (
+	symmetryNone = "none"
+	// left to right
+	symmetryMirror = "mirror"
+	// top to bottom
+	symmetryFlip = "flip"
+	// 180 degrees around the center
+	symmetryRotate = "rotate"
+	// left to right and top to bottom
+	symmetryQuad = "quad"
+)
+
+var symmetryNames = []string{symmetryNone, symmetryMirror, symmetryFlip, symmetryRotate, symmetryQuad}
+
+// mapGenerator places the obstacles of a random map. Every obstacle is
+// placed only if the empty grids stay connected, so a player can walk to
+// every empty grid, and bomb its way to every destructible obstacle.
+type mapGenerator struct {
+	settings *roomSettings
+	rng      *rand.Rand
+	grids    map[Position]ObstacleType
+	// the grids which stay empty
+	reserved map[Position]bool
+}
+
+// genObstacleList generates the obstacle list of a map, the same settings,
+// seed and reserved grids generate the same map
+func genObstacleList(settings *roomSettings, seed int64, reserved []Position) []int {
+	g := &mapGenerator{
+		settings: settings,
+		rng:      rand.New(rand.NewSource(seed)),
+		grids:    map[Position]ObstacleType{},
+		reserved: map[Position]bool{},
+	}
+	for _, pos := range reserved {
+		g.reserved[pos] = true
+	}
+	g.place(indestructibleObstacleType, settings.indestructibleObstacleCount())
+	g.place(destructibleObstacleType, settings.destructibleObstacleCount())
+	return settings.genListFromObstacleMap(g.grids)
+}
+
+// place puts up to count obstacles of the type on the map, by groups of
+// the symmetric grids
+func (g *mapGenerator) place(t ObstacleType, count int) {
+	var candidates []Position
+	for y := 0; y < g.settings.Height; y++ {
+		for x := 0; x < g.settings.Width; x++ {
+			candidates = append(candidates, Position{X: x, Y: y})
+		}
+	}
+	g.rng.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	placed := 0
+	for _, pos := range candidates {
+		if placed >= count {
+			return
+		}
+		group := g.symmetric(pos)
+		if !g.free(group) {
+			continue
+		}
+		var done []Position
+		for _, p := range group {
+			if !g.keepsConnected(p) {
+				break
+			}
+			g.grids[p] = t
+			done = append(done, p)
+		}
+		if len(done) < len(group) {
+			// the group is placed whole or not at all
+			for _, p := range done {
+				delete(g.grids, p)
+			}
+			continue
+		}
+		placed += len(group)
+	}
+}
+
+// symmetric returns the grid and its images by the symmetry of the room
+func (g *mapGenerator) symmetric(pos Position) []Position {
+	w, h := g.settings.Width, g.settings.Height
+	images := []Position{pos}
+	switch g.settings.Symmetry {
+	case symmetryMirror:
+		images = append(images, Position{X: w - 1 - pos.X, Y: pos.Y})
+	case symmetryFlip:
+		images = append(images, Position{X: pos.X, Y: h - 1 - pos.Y})
+	case symmetryRotate:
+		images = append(images, Position{X: w - 1 - pos.X, Y: h - 1 - pos.Y})
+	case symmetryQuad:
+		images = append(images,
+			Position{X: w - 1 - pos.X, Y: pos.Y},
+			Position{X: pos.X, Y: h - 1 - pos.Y},
+			Position{X: w - 1 - pos.X, Y: h - 1 - pos.Y})
+	}
+	// the grids on the axis are their own images
+	var group []Position
+	seen := map[Position]bool{}
+	for _, p := range images {
+		if !seen[p] {
+			seen[p] = true
+			group = append(group, p)
+		}
+	}
+	return group
+}
+
+func (g *mapGenerator) free(group []Position) bool {
+	for _, p := range group {
+		if _, ok := g.grids[p]; ok || g.reserved[p] {
+			return false
+		}
+	}
+	return true
+}
+
+func (g *mapGenerator) empty(p Position) bool {
+	if !g.settings.validCoordinate(p) {
+		return false
+	}
+	_, ok := g.grids[p]
+	return !ok
+}
+
+// keepsConnected returns true if the empty neighbours of the grid are still
+// connected around it when the grid is taken, so the empty grids stay
+// connected without walking through it
+func (g *mapGenerator) keepsConnected(pos Position) bool {
+	// the 8 grids around pos in order, the even ones are its neighbours
+	ring := []Position{
+		{X: pos.X, Y: pos.Y - 1}, {X: pos.X + 1, Y: pos.Y - 1},
+		{X: pos.X + 1, Y: pos.Y}, {X: pos.X + 1, Y: pos.Y + 1},
+		{X: pos.X, Y: pos.Y + 1}, {X: pos.X - 1, Y: pos.Y + 1},
+		{X: pos.X - 1, Y: pos.Y}, {X: pos.X - 1, Y: pos.Y - 1},
+	}
+	// count the runs of empty grids around pos which have a neighbour
+	runs := 0
+	for i := range ring {
+		if !g.empty(ring[i]) || g.empty(ring[(i+len(ring)-1)%len(ring)]) {
+			// not the first grid of a run
+			continue
+		}
+		for j := i; g.empty(ring[j%len(ring)]); j++ {
+			if j%2 == 0 {
+				runs++
+				break
+			}
+		}
+	}
+	// no run if all the grids around are empty
+	return runs <= 1
+}
+
+// newMapSeed is the seed of the next random map, mapSeed of the room or
+// a new one every time
+func (s *roomSettings) newMapSeed() int64 {
+	if s.MapSeed != 0 {
+		return s.MapSeed
+	}
+	return rand.Int63()
+}
+
+// genRandomObstacleList generates a random map, the players and the grids
+// next to them stay empty
+func (w *World) genRandomObstacleList(seed int64) []int {
+	var reserved []Position
+	for _, info := range w.nameToPlayers {
+		reserved = append(reserved, info.pos)
+		for _, dir := range []Direction{dirLeft, dirRight, dirUp, dirDown} {
+			reserved = append(reserved, w.settings.getNextPosition(info.pos, dir))
+		}
+	}
+	log.Debugf("[genRandomObstacleList] seed %d", seed)
+	return genObstacleList(w.settings, seed, reserved)
+}
+
+// genRandomMap is the update to a new random map
+func (w *World) genRandomMap() *UpdateMapEvent {
+	seed := w.settings.newMapSeed()
+	return &UpdateMapEvent{
+		Obstacles: w.genRandomObstacleList(seed),
+		seed:      seed,
+	}
+}
+
+// formatObstacleList draws the obstacles as the grid of a map file
+func (s *roomSettings) formatObstacleList(list []int) string {
+	obstacleMap := s.genObstacleMapFromList(list, nil)
+	grid := strings.Builder{}
+	for y := 0; y < s.Height; y++ {
+		for x := 0; x < s.Width; x++ {
+			switch obstacleMap[Position{X: x, Y: y}] {
+			case indestructibleObstacleType:
+				grid.WriteRune(indestructibleCell)
+			case destructibleObstacleType:
+				grid.WriteRune(destructibleCell)
+			default:
+				grid.WriteRune(emptyCell)
+			}
+		}
+		grid.WriteString("\n")
+	}
+	return grid.String()
+}
+
+// printRandomMap prints the map of the seed as a map file, add the spawns
+// to play it with -map
+func printRandomMap(roomName string, seed int64) error {
+	settings := getRoomSettings(roomName)
+	if err := settings.validate(); err != nil {
+		return err
+	}
+	fmt.Printf("# generated by seed %d, symmetry %s\nname: seed-%d\ngrid: |\n", seed, settings.Symmetry, seed)
+	for _, row := range strings.Split(strings.TrimSpace(settings.formatObstacleList(genObstacleList(settings, seed, nil))), "\n") {
+		fmt.Println("  " + row)
+	}
+	return nil
+}
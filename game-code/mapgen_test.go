@@ -0,0 +1,116 @@
+package main
+
+import (
+	"testing"
+)
+
+// emptyGridsConnected returns true if a player can walk from any empty grid
+// of the obstacle map to every other one
+func emptyGridsConnected(settings *roomSettings, obstacles map[Position]ObstacleType) bool {
+	var start *Position
+	empty := 0
+	for y := 0; y < settings.Height; y++ {
+		for x := 0; x < settings.Width; x++ {
+			pos := Position{X: x, Y: y}
+			if _, ok := obstacles[pos]; !ok {
+				empty++
+				start = &pos
+			}
+		}
+	}
+	if start == nil {
+		return true
+	}
+	reached := map[Position]bool{*start: true}
+	queue := []Position{*start}
+	for len(queue) > 0 {
+		pos := queue[0]
+		queue = queue[1:]
+		for _, next := range []Position{
+			{X: pos.X - 1, Y: pos.Y}, {X: pos.X + 1, Y: pos.Y},
+			{X: pos.X, Y: pos.Y - 1}, {X: pos.X, Y: pos.Y + 1},
+		} {
+			if _, ok := obstacles[next]; ok || reached[next] || !settings.validCoordinate(next) {
+				continue
+			}
+			reached[next] = true
+			queue = append(queue, next)
+		}
+	}
+	return len(reached) == empty
+}
+
+func TestGenObstacleListKeepsConnected(t *testing.T) {
+	tests := []struct {
+		name                         string
+		width, height                int
+		indestructible, destructible float64
+		symmetry                     string
+	}{
+		{name: "default", width: 30, height: 25, indestructible: 0.2, destructible: 0.25, symmetry: symmetryNone},
+		{name: "dense", width: 30, height: 25, indestructible: 0.4, destructible: 0.4, symmetry: symmetryNone},
+		{name: "small", width: 5, height: 5, indestructible: 0.3, destructible: 0.3, symmetry: symmetryNone},
+		{name: "mirror", width: 15, height: 11, indestructible: 0.3, destructible: 0.3, symmetry: symmetryMirror},
+		{name: "flip", width: 15, height: 11, indestructible: 0.3, destructible: 0.3, symmetry: symmetryFlip},
+		{name: "rotate", width: 15, height: 11, indestructible: 0.3, destructible: 0.3, symmetry: symmetryRotate},
+		{name: "quad", width: 16, height: 12, indestructible: 0.3, destructible: 0.3, symmetry: symmetryQuad},
+	}
+	reserved := []Position{{X: 0, Y: 0}, {X: 1, Y: 0}, {X: 0, Y: 1}, {X: 4, Y: 4}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settings := defaultRoomSettings()
+			settings.Width, settings.Height = tt.width, tt.height
+			settings.IndestructibleDensity = tt.indestructible
+			settings.DestructibleDensity = tt.destructible
+			settings.Symmetry = tt.symmetry
+			for seed := int64(1); seed <= 20; seed++ {
+				list := genObstacleList(settings, seed, reserved)
+				if len(list) == 0 {
+					t.Fatalf("seed %d places no obstacle", seed)
+				}
+				obstacles := settings.genObstacleMapFromList(list, nil)
+				if !emptyGridsConnected(settings, obstacles) {
+					t.Fatalf("seed %d walls in a grid:\n%s", seed, settings.formatObstacleList(list))
+				}
+				for _, pos := range reserved {
+					if _, ok := obstacles[pos]; ok {
+						t.Fatalf("seed %d places an obstacle on the reserved grid %d,%d", seed, pos.X, pos.Y)
+					}
+				}
+				again := settings.genObstacleMapFromList(genObstacleList(settings, seed, reserved), nil)
+				if !equalObstacles(again, obstacles) {
+					t.Fatalf("seed %d generates another map the second time", seed)
+				}
+			}
+		})
+	}
+}
+
+func TestGenObstacleListIsSymmetric(t *testing.T) {
+	tests := []struct {
+		symmetry string
+		image    func(w, h int, pos Position) Position
+	}{
+		{symmetryMirror, func(w, h int, pos Position) Position { return Position{X: w - 1 - pos.X, Y: pos.Y} }},
+		{symmetryFlip, func(w, h int, pos Position) Position { return Position{X: pos.X, Y: h - 1 - pos.Y} }},
+		{symmetryRotate, func(w, h int, pos Position) Position { return Position{X: w - 1 - pos.X, Y: h - 1 - pos.Y} }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.symmetry, func(t *testing.T) {
+			settings := defaultRoomSettings()
+			settings.Width, settings.Height = 15, 11
+			settings.Symmetry = tt.symmetry
+			obstacles := settings.genObstacleMapFromList(genObstacleList(settings, 42, nil), nil)
+			for pos, kind := range obstacles {
+				image := tt.image(settings.Width, settings.Height, pos)
+				if pos == (Position{}) || image == (Position{}) {
+					// a destructible obstacle can't be told at grid 0, see genObstacleMapFromList
+					continue
+				}
+				if obstacles[image] != kind {
+					t.Fatalf("%d,%d isn't the image of %d,%d", image.X, image.Y, pos.X, pos.Y)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// defaultMemoryBroker is shared by all the memoryTransport in this process
+var defaultMemoryBroker = newDefaultMemoryBroker()
+
+func newDefaultMemoryBroker() *memoryBroker {
+	b := newMemoryBroker()
+	// emulate the score function deployed on the cluster
+	scoreboard := scoreboardFunction()
+	b.registerFunction("-event-topic", scoreboard)
+	b.registerFunction("-state-topic", scoreboard)
+	return b
+}
+
+// memoryTransport is the Transport connecting to a memoryBroker, closing it
+// releases all its consumers like a client disconnecting from Pulsar
+type memoryTransport struct {
+	broker *memoryBroker
+	// the events are encoded and decoded like on a real topic
+	codec eventCodec
+	// the name of the producers, empty lets the broker name them
+	producerName string
+
+	lock sync.Mutex
+	// consumers created by subscribe
+	consumers []*brokerConsumer
+	// the topics this transport holds its producer name on
+	producerTopics []string
+}
+
+func newMemoryTransport(broker *memoryBroker, codec eventCodec, producerName string) *memoryTransport {
+	return &memoryTransport{
+		broker:       broker,
+		codec:        codec,
+		producerName: producerName,
+	}
+}
+
+// producer claims the producer name on topic when first publish, like
+// creating a producer on Pulsar
+func (t *memoryTransport) producer(topic string) (string, error) {
+	if t.producerName == "" {
+		return "", nil
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if stringsContain(t.producerTopics, topic) {
+		return t.producerName, nil
+	}
+	if err := t.broker.addProducer(topic, t.producerName, t); err != nil {
+		return "", err
+	}
+	t.producerTopics = append(t.producerTopics, topic)
+	return t.producerName, nil
+}
+
+func (t *memoryTransport) publish(topic, key string, msg *EventMessage) ([]byte, error) {
+	producer, err := t.producer(topic)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := t.codec.encode(msg)
+	if err != nil {
+		return nil, err
+	}
+	// the consumers don't share msg with the producer
+	decoded, err := t.codec.decode(payload)
+	if err != nil {
+		return nil, err
+	}
+	m := &brokerMessage{key: key, producer: producer, event: decoded}
+	t.broker.publish(topic, m)
+	return m.received().id, nil
+}
+
+func (t *memoryTransport) subscribe(topic, subscriptionName string, exclusive bool) (eventSubscription, error) {
+	consumer, err := t.broker.subscribe(topic, subscriptionName, exclusive, latestPosition)
+	if err != nil {
+		return nil, err
+	}
+	t.lock.Lock()
+	t.consumers = append(t.consumers, consumer)
+	t.lock.Unlock()
+	return &memorySubscription{broker: t.broker, consumer: consumer}, nil
+}
+
+func (t *memoryTransport) createReader(topic string, start position) (eventReader, error) {
+	return &memoryReader{
+		broker: t.broker,
+		topic:  topic,
+		offset: t.broker.offsetOf(topic, start),
+	}, nil
+}
+
+func (t *memoryTransport) listenTable(topic string, f func(key, value string)) error {
+	t.broker.listenTable(topic, f)
+	return nil
+}
+
+func (t *memoryTransport) Close() {
+	t.lock.Lock()
+	consumers := t.consumers
+	t.consumers = nil
+	producerTopics := t.producerTopics
+	t.producerTopics = nil
+	t.lock.Unlock()
+	for _, c := range consumers {
+		t.broker.closeConsumer(c)
+	}
+	for _, topic := range producerTopics {
+		t.broker.removeProducer(topic, t.producerName, t)
+	}
+}
+
+type memorySubscription struct {
+	broker   *memoryBroker
+	consumer *brokerConsumer
+}
+
+func (s *memorySubscription) receive() <-chan *receivedMessage {
+	return s.consumer.outCh
+}
+
+// broken is never closed, the memory broker doesn't lose its consumers
+func (s *memorySubscription) broken() <-chan struct{} {
+	return nil
+}
+
+func (s *memorySubscription) seek(start position) error {
+	s.broker.seek(s.consumer, start)
+	return nil
+}
+
+func (s *memorySubscription) unsubscribe() error {
+	return s.broker.unsubscribe(s.consumer)
+}
+
+func (s *memorySubscription) Close() {
+	s.broker.closeConsumer(s.consumer)
+}
+
+type memoryReader struct {
+	broker *memoryBroker
+	topic  string
+	// offset of the next message
+	offset int
+}
+
+func (r *memoryReader) hasNext() bool {
+	return r.offset < r.broker.size(r.topic)
+}
+
+func (r *memoryReader) next(ctx context.Context) (*receivedMessage, error) {
+	msg, err := r.broker.read(ctx, r.topic, r.offset)
+	if err != nil {
+		return nil, err
+	}
+	r.offset++
+	return msg.received(), nil
+}
+
+func (r *memoryReader) Close() {
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"time"
+)
+
+const (
+	// a move which hasn't come back after moveTimeout is lost or rejected,
+	// the prediction goes back to where the world is
+	moveTimeout = time.Second
+	// the moves of the local player on their way at most, a held key
+	// doesn't send more before they come back
+	maxPendingMoves = 4
+)
+
+// pendingMove is a move of the local player sent to the room but not
+// applied to the world yet
+type pendingMove struct {
+	pos  Position
+	sent time.Time
+}
+
+// moveInterval is the time to walk a grid holding a key at the speed
+func (s *roomSettings) moveInterval(speed int) time.Duration {
+	return s.MoveInterval / time.Duration(speed)
+}
+
+// canMove returns true if the player can walk to the next grid pos, a
+// player with kick walks into bombs to push them
+func (w *World) canMove(player *playerInfo, pos Position) bool {
+	if pos == player.pos || !w.settings.validCoordinate(pos) {
+		return false
+	}
+	if _, ok := w.obstacleMap[pos]; ok {
+		return false
+	}
+	if _, ok := w.posToBombs[pos]; ok && !player.powerUps.Kick {
+		return false
+	}
+	return true
+}
+
+// playerTrack slides a drawn player from where it was to its grid
+type playerTrack struct {
+	fromX, fromY float64
+	to           Position
+	start        time.Time
+	duration     time.Duration
+}
+
+// at returns where the player is drawn at now, in grids
+func (t *playerTrack) at(now time.Time) (float64, float64) {
+	f := 1.0
+	if elapsed := now.Sub(t.start); elapsed < t.duration {
+		f = float64(elapsed) / float64(t.duration)
+	}
+	return t.fromX + (float64(t.to.X)-t.fromX)*f, t.fromY + (float64(t.to.Y)-t.fromY)*f
+}
+
+// interpolator draws the players sliding between the grids they're
+// received at, at their speed, instead of jumping from grid to grid. It's
+// only for drawing, the world doesn't know it.
+type interpolator struct {
+	tracks map[string]*playerTrack
+	// the grid the local player is predicted at, nil to draw it where the
+	// world has it
+	predicted func() Position
+}
+
+func newInterpolator() *interpolator {
+	return &interpolator{tracks: map[string]*playerTrack{}}
+}
+
+// pos returns where the player is drawn at now, in grids
+func (i *interpolator) pos(w *World, p *playerInfo, now time.Time) (float64, float64) {
+	if i.predicted != nil && p.name == w.localPlayerName && p.alive {
+		predicted := *p
+		predicted.pos = i.predicted()
+		p = &predicted
+	}
+	t, ok := i.tracks[p.name]
+	if !ok {
+		t = &playerTrack{fromX: float64(p.pos.X), fromY: float64(p.pos.Y), to: p.pos}
+		i.tracks[p.name] = t
+	}
+	if t.to != p.pos {
+		x, y := t.at(now)
+		if distance(t.to, p.pos) > 1 {
+			// revived or joined again, don't slide across the map
+			x, y = float64(p.pos.X), float64(p.pos.Y)
+		}
+		*t = playerTrack{
+			fromX:    x,
+			fromY:    y,
+			to:       p.pos,
+			start:    now,
+			duration: w.settings.moveInterval(p.powerUps.speed()),
+		}
+	}
+	return t.at(now)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"time"
+)
+
+// maxPlayerSpeed is the highest maxSpeed of a room, a player walks a grid
+// every moveInterval/maxSpeed
+const maxPlayerSpeed = 10
+
+// powerUpKind is what a power-up gives to the player who collects it
+type powerUpKind int
+
+const (
+	// one more bomb at the same time
+	powerUpBomb powerUpKind = iota + 1
+	// the flame of the bombs reaches one more grid
+	powerUpFlame
+	// the player moves faster
+	powerUpSpeed
+	// the player can push bombs by walking into them
+	powerUpKick
+)
+
+var powerUpKinds = []powerUpKind{powerUpBomb, powerUpFlame, powerUpSpeed, powerUpKick}
+
+// powerUpLetters are drawn on the power-ups
+var powerUpLetters = map[powerUpKind]string{
+	powerUpBomb:  "B",
+	powerUpFlame: "F",
+	powerUpSpeed: "S",
+	powerUpKick:  "K",
+}
+
+// powerUpSettings is how power-ups appear in a room and how far a player
+// grows with them
+type powerUpSettings struct {
+	// the chance that a destroyed destructible obstacle drops a power-up
+	DropChance float64 `yaml:"dropChance" json:"dropChance"`
+	// a power-up appears on a power-up cell of the map file every
+	// SpawnInterval, 0 disables them
+	SpawnInterval time.Duration `yaml:"spawnInterval" json:"spawnInterval"`
+	// a player sets Bombs bombs at the same time without power-ups, and
+	// MaxBombs with them
+	Bombs    int `yaml:"bombs" json:"bombs"`
+	MaxBombs int `yaml:"maxBombs" json:"maxBombs"`
+	// the longest flame, see bombLength for the shortest
+	MaxFlame int `yaml:"maxFlame" json:"maxFlame"`
+	// the fastest speed, a player starts at speed 1
+	MaxSpeed int `yaml:"maxSpeed" json:"maxSpeed"`
+}
+
+var defaultPowerUpSettings = powerUpSettings{
+	DropChance:    0.3,
+	SpawnInterval: 15 * time.Second,
+	Bombs:         1,
+	MaxBombs:      8,
+	MaxFlame:      10,
+	MaxSpeed:      4,
+}
+
+func (s *powerUpSettings) validate(bombLength int) error {
+	if s.DropChance < 0 || s.DropChance > 1 {
+		return errors.New("powerUps.dropChance must be 0 to 1")
+	}
+	if s.SpawnInterval < 0 {
+		return errors.New("powerUps.spawnInterval can't be negative")
+	}
+	if s.Bombs <= 0 || s.MaxBombs < s.Bombs || s.MaxFlame < bombLength || s.MaxSpeed < 1 {
+		return errors.New("powerUps.bombs must be positive, and the max ones at least the starting ones")
+	}
+	if s.MaxSpeed > maxPlayerSpeed {
+		return fmt.Errorf("powerUps.maxSpeed can't be more than %d", maxPlayerSpeed)
+	}
+	return nil
+}
+
+// playerPowerUps are the power-ups a player collected, they're lost when
+// the player dies
+type playerPowerUps struct {
+	Bombs int  `json:"bombs"`
+	Flame int  `json:"flame"`
+	Speed int  `json:"speed"`
+	Kick  bool `json:"kick"`
+}
+
+// collect adds the power-up, up to the max of the room
+func (p *playerPowerUps) collect(kind powerUpKind, s *roomSettings) {
+	switch kind {
+	case powerUpBomb:
+		if s.PowerUps.Bombs+p.Bombs < s.PowerUps.MaxBombs {
+			p.Bombs++
+		}
+	case powerUpFlame:
+		if s.BombLength+p.Flame < s.PowerUps.MaxFlame {
+			p.Flame++
+		}
+	case powerUpSpeed:
+		if 1+p.Speed < s.PowerUps.MaxSpeed {
+			p.Speed++
+		}
+	case powerUpKick:
+		p.Kick = true
+	}
+}
+
+// bombs is how many bombs the player sets at the same time
+func (p *playerPowerUps) bombs(s *roomSettings) int {
+	return s.PowerUps.Bombs + p.Bombs
+}
+
+// flame is how far the flame of the player's bombs reaches
+func (p *playerPowerUps) flame(s *roomSettings) int {
+	return s.BombLength + p.Flame
+}
+
+// speed is 1 without power-ups
+func (p *playerPowerUps) speed() int {
+	return 1 + p.Speed
+}
+
+// dropPowerUp may drop a power-up where the bomb destroyed an obstacle. The
+// drop is decided by a hash of the bomb and the grid instead of random, so
+// every world drops the same power-ups.
+func (w *World) dropPowerUp(bombName string, pos Position) {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s:%d,%d", bombName, pos.X, pos.Y)
+	sum := h.Sum64()
+	if float64(sum%1000) >= w.settings.PowerUps.DropChance*1000 {
+		return
+	}
+	w.powerUps[pos] = powerUpKinds[(sum/1000)%uint64(len(powerUpKinds))]
+}
+
+// checkPowerUps judges the players on power-ups like checkDeaths, the
+// power-up is the player's when the PowerUpCollectEvent comes back
+func (w *World) checkPowerUps() {
+	for _, player := range w.judgedPlayers() {
+		if !player.alive {
+			continue
+		}
+		kind, ok := w.powerUps[player.pos]
+		if !ok {
+			continue
+		}
+		if tick, ok := w.collecting[player.pos]; ok && w.tick-tick < ticksPerSecond {
+			// the event is on its way, send it again if it's lost
+			continue
+		}
+		w.collecting[player.pos] = w.tick
+		w.emit(&PowerUpCollectEvent{
+			name: player.name,
+			pos:  player.pos,
+			kind: kind,
+		})
+	}
+}
+
+// genPowerUp picks a free power-up cell of the map file and a random kind,
+// it returns nil if the room has no map file or no free cell
+func (w *World) genPowerUp() *PowerUpSpawnEvent {
+	if w.gameMap == nil {
+		return nil
+	}
+	var free []Position
+	for _, pos := range w.gameMap.PowerUps {
+		if _, ok := w.powerUps[pos]; ok {
+			continue
+		}
+		if _, ok := w.obstacleMap[pos]; ok {
+			continue
+		}
+		free = append(free, pos)
+	}
+	if len(free) == 0 {
+		return nil
+	}
+	return &PowerUpSpawnEvent{
+		pos:  free[rand.Intn(len(free))],
+		kind: powerUpKinds[rand.Intn(len(powerUpKinds))],
+	}
+}
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"bytes"
 	"context"
-	"encoding/json"
+	"errors"
 	"github.com/apache/pulsar-client-go/pulsar"
 	log "github.com/sirupsen/logrus"
-	"math"
 	"reflect"
+	"strings"
+	"sync"
+	"time"
 )
 
 const eventJsonSchemaDef = `
@@ -44,6 +47,11 @@ const eventJsonSchemaDef = `
       "name": "Alive",
       "type": "boolean"
     },
+    {
+      "name": "Tick",
+      "type": "long",
+      "default": 0
+    },
     {
       "name": "List",
 		"type": {
@@ -52,11 +60,35 @@ const eventJsonSchemaDef = `
 				"type":"int"
 			}
 		}
+    },
+    {
+      "name": "Version",
+      "type": "int",
+      "default": 0
+    },
+    {
+      "name": "Payload",
+      "type": "string",
+      "default": ""
     }
   ]
 }
 `
 
+var errPlayerLoggedIn = errors.New("this player has logged in")
+
+const (
+	// a message not acknowledged in sendTimeout means the connection is broken
+	sendTimeout = 5 * time.Second
+	// reconnecting waits minReconnectBackoff first, and doubles it after
+	// every failure up to maxReconnectBackoff
+	minReconnectBackoff = time.Second / 2
+	maxReconnectBackoff = 30 * time.Second
+	// a subscription receiving nothing for subscriptionCheckTime checks
+	// that the broker is still there
+	subscriptionCheckTime = 5 * time.Second
+)
+
 // EventMessage is the data in Pulsar
 type EventMessage struct {
 	// Event type
@@ -68,21 +100,51 @@ type EventMessage struct {
 	X       int    `json:"x"`
 	Y       int    `json:"y"`
 	Alive   bool   `json:"alive"`
-	List    []int  `json:"list"`
+	// the logical tick when the event happens, see roomTick
+	Tick int64 `json:"tick"`
+	List []int `json:"list"`
+	// Version of the event type, the messages without it are version 1
+	Version int `json:"version"`
+	// Payload is the json of the data only in some versions of the event type
+	Payload string `json:"payload"`
 }
 
+// pulsarClient connects a player to a room, it speaks through a Transport
 type pulsarClient struct {
 	roomName, playerName string
-	client               pulsar.Client
-	producer             pulsar.Producer
-	consumer             pulsar.Consumer
-	tableView            pulsar.TableView
-	consumeCh            chan pulsar.ConsumerMessage
-	// exclude type
-	exclusiveObstacleConsumer pulsar.Consumer
-	// to read the latest obstacle graph
-	obstacleReader pulsar.Reader
-	// subscribe the obstacle topic,
+	// the room is hosted by a room server, receive its authoritative events
+	authoritative bool
+	// the subscription of the player, it's playerName unless the last
+	// session of the player still holds it
+	subscriptionName string
+	// the token of this session, see takeover
+	token string
+
+	// lock guards the connection, it's replaced when reconnecting
+	lock      sync.Mutex
+	transport Transport
+	// receive the events of the room
+	subscription eventSubscription
+	// true while the connection is broken
+	disconnected bool
+	// true when another session of the player took over
+	replaced bool
+	// listens to the scores again after reconnecting
+	scoreListener func(playerName, score string)
+	// the wait before the next reconnecting, it's reset by a successful publish
+	backoff time.Duration
+
+	// the id of the last received message, which has been acknowledged,
+	// a new subscription resumes after it
+	lastMessageID []byte
+	// the latest snapshot of the room when joining, the subscription
+	// starts from its message
+	snapshot *worldSnapshot
+	// the settings in the config topic of the room
+	settings *roomSettings
+	// the map file of the room in the config topic, nil if the maps are random
+	roomMap *gameMap
+	stats   *clientStats
 	closeCh chan struct{}
 }
 
@@ -91,96 +153,241 @@ func (c *pulsarClient) getEventTopicName() string {
 	return c.roomName + "-event-topic"
 }
 
-// map update event
-func (c *pulsarClient) getMapTopicName() string {
-	return c.roomName + "-map-topic"
+// events accepted by the room server
+func (c *pulsarClient) getStateTopicName() string {
+	return c.roomName + "-state-topic"
 }
 
-// the name for every player to subscribe event topic
-func (c *pulsarClient) getEventSubscriptionName() string {
-	return c.playerName + "-event-sub"
+// the topic to receive the events of room
+func (c *pulsarClient) getReceiveTopicName() string {
+	if c.authoritative {
+		return c.getStateTopicName()
+	}
+	return c.getEventTopicName()
 }
 
-// the name for every player to subscribe map topic
-func (c *pulsarClient) getMapSubscriptionName() string {
-	return c.playerName + "-map-sub"
+// scores calculated by pulsar function
+func (c *pulsarClient) getScoreTopicName() string {
+	return c.roomName + "-score-topic"
 }
 
-// the name for only one player to subscribe map topic, this player will send map update event
-func (c *pulsarClient) getUniqueMapSubscriptionName() string {
-	return c.roomName + "-map-sub"
+// the name for every player to subscribe event topic
+func (c *pulsarClient) getEventSubscriptionName() string {
+	return c.playerName + "-event-sub"
 }
 
 func (c *pulsarClient) Close() {
-	c.producer.Close()
-	c.consumer.Unsubscribe()
-	c.consumer.Close()
-	c.client.Close()
-	c.tableView.Close()
-	close(c.consumeCh)
 	close(c.closeCh)
+	removeSessionToken(c.roomName, c.playerName, c.token)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.subscription != nil {
+		c.subscription.unsubscribe()
+		c.subscription.Close()
+		c.transport.Close()
+	}
 }
 
-func newPulsarClient(roomName, playerName string) *pulsarClient {
-	topicName := roomName + "-event-topic"
-	subscriptionName := playerName
-	client, err := pulsar.NewClient(readClientOptionFromYaml())
+func newPulsarClient(roomName, playerName string, authoritative bool) (*pulsarClient, error) {
+	c := &pulsarClient{
+		playerName:       playerName,
+		roomName:         roomName,
+		authoritative:    authoritative,
+		subscriptionName: playerName,
+		token:            newSessionToken(),
+		stats:            &clientStats{},
+		closeCh:          make(chan struct{}),
+	}
+	lastToken := readSessionToken(roomName, playerName)
+	err := c.connect()
+	if err == errPlayerLoggedIn {
+		err = c.takeover()
+	}
 	if err != nil {
-		log.Fatal("[newPulsarClient]", err)
+		return nil, err
 	}
+	if lastToken != "" {
+		// the last session on this machine crashed, or has been taken over
+		c.removeStaleSubscription()
+	}
+	saveSessionToken(roomName, playerName, c.token)
 
-	// player event topicName
-	producer, err := client.CreateProducer(pulsar.ProducerOptions{
-		Topic:           topicName,
-		DisableBatching: true,
-		// use schema to confirm the structure of message
-		Schema: pulsar.NewJSONSchema(eventJsonSchemaDef, nil),
-	})
+	c.settings, c.roomMap, err = joinRoomSettings(c.transport, roomName)
 	if err != nil {
-		log.Fatal(err)
+		c.Close()
+		return nil, err
 	}
-	consumeCh := make(chan pulsar.ConsumerMessage)
-	consumer, err := client.Subscribe(pulsar.ConsumerOptions{
-		Topic:            topicName,
-		SubscriptionName: subscriptionName,
-		Type:             pulsar.Exclusive,
-		MessageChannel:   consumeCh,
-		// use schema to confirm the structure of message
-		Schema: pulsar.NewJSONSchema(eventJsonSchemaDef, nil),
-	})
+
+	c.snapshot, err = readLatestSnapshot(c.transport, roomName, c.getReceiveTopicName())
 	if err != nil {
-		log.Fatal("this player has logged in")
+		log.Warning("[newPulsarClient] read snapshot failed:", err)
 	}
-	// only handle new event
-	err = consumer.Seek(pulsar.LatestMessageID())
-	if err != nil {
-		log.Fatal(err)
+	if c.snapshot != nil {
+		// handle the events after the snapshot
+		err = c.subscription.seek(position{id: c.snapshot.MessageID})
+		if err != nil {
+			log.Warning("[newPulsarClient] the message of snapshot is gone:", err)
+			c.snapshot = nil
+		} else {
+			c.lastMessageID = c.snapshot.MessageID
+		}
 	}
+	return c, nil
+}
 
-	tableView, err := client.CreateTableView(pulsar.TableViewOptions{
-		Topic:           roomName + "-score-topic",
-		Schema:          pulsar.NewStringSchema(nil),
-		SchemaValueType: reflect.TypeOf(""),
-	})
+// connect creates the transport and the subscription of the room, which
+// resumes after the last received message, or starts from the latest one
+func (c *pulsarClient) connect() error {
+	// the room server takes the intents of the player from this producer only
+	transport, err := newTransport(c.playerName)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	subscription, err := transport.subscribe(c.getReceiveTopicName(), c.subscriptionName, true)
+	if err != nil {
+		transport.Close()
+		if errors.Is(err, errExclusiveConsumerBusy) {
+			// another session of the player holds the subscription
+			return errPlayerLoggedIn
+		}
+		return err
+	}
+	if c.lastMessageID != nil {
+		err = subscription.seek(position{id: c.lastMessageID})
+		if err != nil {
+			log.Warning("[pulsarClient] the last received message is gone:", err)
+			c.lastMessageID = nil
+		}
+	}
+	if c.lastMessageID == nil {
+		// only handle new event
+		err = subscription.seek(latestPosition)
+		if err != nil {
+			subscription.Close()
+			transport.Close()
+			return err
+		}
 	}
 
-	return &pulsarClient{
-		tableView:  tableView,
-		playerName: playerName,
-		roomName:   roomName,
-		client:     client,
-		producer:   producer,
-		consumer:   consumer,
-		consumeCh:  consumeCh,
-		closeCh:    make(chan struct{}),
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	select {
+	case <-c.closeCh:
+		subscription.Close()
+		transport.Close()
+		return errors.New("the client is closed")
+	default:
 	}
+	if c.scoreListener != nil {
+		err = transport.listenTable(c.getScoreTopicName(), c.scoreListener)
+		if err != nil {
+			subscription.Close()
+			transport.Close()
+			return err
+		}
+	}
+	c.transport = transport
+	c.subscription = subscription
+	c.disconnected = false
+	return nil
+}
+
+// reconnect replaces the broken connection, it retries with backoff until
+// it connects or the client is closed. The map owner is elected again on
+// the new connection.
+func (c *pulsarClient) reconnect() bool {
+	c.lock.Lock()
+	select {
+	case <-c.closeCh:
+		// closed by Close, not broken
+		c.lock.Unlock()
+		return false
+	default:
+	}
+	c.disconnected = true
+	c.subscription.Close()
+	c.transport.Close()
+	c.transport, c.subscription = nil, nil
+	c.lock.Unlock()
+
+	for {
+		// a connection broken again soon waits longer too
+		if c.backoff == 0 {
+			c.backoff = minReconnectBackoff
+		}
+		log.Warningf("[pulsarClient] connection is broken, reconnect in %v", c.backoff)
+		select {
+		case <-time.After(c.backoff):
+		case <-c.closeCh:
+			return false
+		}
+		c.backoff *= 2
+		if c.backoff > maxReconnectBackoff {
+			c.backoff = maxReconnectBackoff
+		}
+		err := c.connect()
+		if err == nil {
+			log.Info("[pulsarClient] reconnected")
+			return true
+		}
+		log.Warning("[pulsarClient] reconnect failed:", err)
+	}
+}
+
+// reconnecting returns true while the connection is broken
+func (c *pulsarClient) reconnecting() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.disconnected
+}
+
+// getTransport returns the current connection, nil while reconnecting
+func (c *pulsarClient) getTransport() Transport {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.transport
+}
+
+// connection returns the current transport and subscription, nil while
+// reconnecting or after leaving the room
+func (c *pulsarClient) connection() (Transport, eventSubscription) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.transport, c.subscription
+}
+
+// pulsarTransport is the Transport on a Pulsar cluster
+type pulsarTransport struct {
+	client pulsar.Client
+	codec  eventCodec
+	// the name of the producers, empty lets the broker name them
+	producerName string
+
+	lock sync.Mutex
+	// one producer for every topic, created when first publish
+	producers  map[string]pulsar.Producer
+	tableViews []pulsar.TableView
+}
+
+func newPulsarTransport(codec eventCodec, producerName string) (*pulsarTransport, error) {
+	client, err := pulsar.NewClient(readClientOptionFromYaml())
+	if err != nil {
+		return nil, err
+	}
+	return &pulsarTransport{
+		client:       client,
+		codec:        codec,
+		producerName: producerName,
+		producers:    map[string]pulsar.Producer{},
+	}, nil
 }
 
 func readClientOptionFromYaml() pulsar.ClientOptions {
 	clientOptions := pulsar.ClientOptions{
 		URL: pulsarConfig.BrokerUrl,
+		// fail fast, the client reconnects with backoff
+		ConnectionTimeout: sendTimeout,
+		OperationTimeout:  2 * sendTimeout,
 	}
 	if pulsarConfig.OAuth.Enabled {
 		oauth := pulsar.NewAuthenticationOAuth2(map[string]string{
@@ -194,87 +401,372 @@ func readClientOptionFromYaml() pulsar.ClientOptions {
 	return clientOptions
 }
 
-// try grab exclusive consumer, if success, send new random graph
-func (c *pulsarClient) canUpdateObstacles() bool {
-	// every minute update random obstacle
-	if c.exclusiveObstacleConsumer != nil {
-		return true
-	}
-	// all player will get same subscription name
-	obstacleSubscriptionName := c.getUniqueMapSubscriptionName()
-	obstacleConsumerCh := make(chan pulsar.ConsumerMessage)
-	obstacleConsumer, err := c.client.Subscribe(pulsar.ConsumerOptions{
-		Topic: c.getMapTopicName(),
-		// all player clients should have same subscription name
-		// then Exclusive type can work
-		SubscriptionName: obstacleSubscriptionName,
-		// only one consumer can subscribe obstacle topic
-		Type:                        pulsar.Exclusive,
-		MessageChannel:              obstacleConsumerCh,
-		SubscriptionInitialPosition: pulsar.SubscriptionPositionLatest,
+func (t *pulsarTransport) getProducer(topic string) (pulsar.Producer, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if producer, ok := t.producers[topic]; ok {
+		return producer, nil
+	}
+	producer, err := t.client.CreateProducer(pulsar.ProducerOptions{
+		Topic: topic,
+		// the broker rejects a second producer with the same name on a topic
+		Name:            t.producerName,
+		DisableBatching: true,
+		SendTimeout:     sendTimeout,
+		// use schema to confirm the structure of message
+		Schema: t.codec.schema(),
 	})
 	if err != nil {
-		// subscription already has other consumers
-		return false
-	} else {
-		c.exclusiveObstacleConsumer = obstacleConsumer
-		return true
+		return nil, err
+	}
+	t.producers[topic] = producer
+	return producer, nil
+}
+
+func (t *pulsarTransport) publish(topic, key string, msg *EventMessage) ([]byte, error) {
+	producer, err := t.getProducer(topic)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := t.codec.encode(msg)
+	if err != nil {
+		return nil, err
+	}
+	id, err := producer.Send(context.Background(), &pulsar.ProducerMessage{
+		Key:     key,
+		Payload: payload,
+	})
+	if err != nil {
+		return nil, err
 	}
+	return id.Serialize(), nil
+}
 
-	// now, this player is the first consumer, update the map obstacle topic
-	//c.updateObstacleTopic(newMap)
+func (t *pulsarTransport) subscribe(topic, subscriptionName string, exclusive bool) (eventSubscription, error) {
+	subscriptionType := pulsar.Shared
+	if exclusive {
+		subscriptionType = pulsar.Exclusive
+	}
+	consumeCh := make(chan pulsar.ConsumerMessage)
+	consumer, err := t.client.Subscribe(pulsar.ConsumerOptions{
+		Topic:            topic,
+		SubscriptionName: subscriptionName,
+		Type:             subscriptionType,
+		MessageChannel:   consumeCh,
+		// use schema to confirm the structure of message
+		Schema: t.codec.schema(),
+	})
+	if consumerBusy(err) {
+		return nil, errExclusiveConsumerBusy
+	}
+	if err != nil {
+		return nil, err
+	}
+	s := &pulsarSubscription{
+		client:    t.client,
+		topic:     topic,
+		consumer:  consumer,
+		codec:     t.codec,
+		consumeCh: consumeCh,
+		outCh:     make(chan *receivedMessage),
+		brokenCh:  make(chan struct{}),
+		closeCh:   make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
 
+// consumerBusy returns true if the broker rejected the consumer because an
+// exclusive consumer is already connected
+func consumerBusy(err error) bool {
+	if err == nil {
+		return false
+	}
+	var e *pulsar.Error
+	if errors.As(err, &e) {
+		return e.Result() == pulsar.ConsumerBusy
+	}
+	// the client reports the errors of the broker by their names
+	return strings.Contains(err.Error(), "ConsumerBusy")
 }
 
-func (c *pulsarClient) readLatestEvent(topicName string) Event {
-	reader, err := c.client.CreateReader(pulsar.ReaderOptions{
-		Topic: topicName,
-		// get the latest message
-		StartMessageID:          pulsar.LatestMessageID(),
+func (t *pulsarTransport) createReader(topic string, start position) (eventReader, error) {
+	startMessageID, err := start.messageID()
+	if err != nil {
+		return nil, err
+	}
+	reader, err := t.client.CreateReader(pulsar.ReaderOptions{
+		Topic:                   topic,
+		StartMessageID:          startMessageID,
 		StartMessageIDInclusive: true,
+		Schema:                  t.codec.schema(),
 	})
+	if err != nil {
+		return nil, err
+	}
+	if !start.publishTime.IsZero() {
+		err = reader.SeekByTime(start.publishTime)
+		if err != nil {
+			reader.Close()
+			return nil, err
+		}
+	}
+	return &pulsarReader{reader: reader, codec: t.codec}, nil
+}
+
+// messageID converts the position to pulsar message id, a position of
+// publish time starts from the earliest message and seeks by time later
+func (p position) messageID() (pulsar.MessageID, error) {
+	if p.id != nil {
+		return pulsar.DeserializeMessageID(p.id)
+	}
+	if p.earliest || !p.publishTime.IsZero() {
+		return pulsar.EarliestMessageID(), nil
+	}
+	return pulsar.LatestMessageID(), nil
+}
+
+func (t *pulsarTransport) listenTable(topic string, f func(key, value string)) error {
+	tableView, err := t.client.CreateTableView(pulsar.TableViewOptions{
+		Topic:           topic,
+		Schema:          pulsar.NewStringSchema(nil),
+		SchemaValueType: reflect.TypeOf(""),
+	})
+	if err != nil {
+		return err
+	}
+	t.lock.Lock()
+	t.tableViews = append(t.tableViews, tableView)
+	t.lock.Unlock()
+	return tableView.ForEachAndListen(func(key string, i interface{}) error {
+		f(key, *i.(*string))
+		return nil
+	})
+}
+
+func (t *pulsarTransport) Close() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, producer := range t.producers {
+		producer.Close()
+	}
+	for _, tableView := range t.tableViews {
+		tableView.Close()
+	}
+	t.client.Close()
+}
+
+type pulsarSubscription struct {
+	client    pulsar.Client
+	topic     string
+	consumer  pulsar.Consumer
+	codec     eventCodec
+	consumeCh chan pulsar.ConsumerMessage
+	outCh     chan *receivedMessage
+	// closed when the consumer fails, see broken
+	brokenCh chan struct{}
+	closeCh  chan struct{}
+}
+
+// forward the consumed messages to outCh, until the consumer fails to
+// acknowledge a message, or the broker is gone while nothing is received
+func (s *pulsarSubscription) run() {
+	check := time.NewTicker(subscriptionCheckTime)
+	defer check.Stop()
+	received := false
+	for {
+		select {
+		case cm := <-s.consumeCh:
+			msg := cm.Message
+			if msg == nil {
+				log.Warning("receive a nil message")
+				break
+			}
+			received = true
+			actionMsg, err := s.codec.decode(msg.Payload())
+			if err != nil {
+				log.Error("[pulsarSubscription]", err)
+				break
+			}
+			log.Infof("receive %s from pulsar, %d bytes", actionMsg.Type, len(msg.Payload()))
+			if err = cm.Ack(msg); err != nil {
+				log.Warning("[pulsarSubscription] ack failed:", err)
+				close(s.brokenCh)
+				return
+			}
+			select {
+			case s.outCh <- newReceivedMessage(msg, actionMsg):
+			case <-s.closeCh:
+				return
+			}
+		case <-check.C:
+			if received {
+				received = false
+				break
+			}
+			// a quiet room, or a consumer waiting for a broker that's gone
+			if _, err := s.client.TopicPartitions(s.topic); err != nil {
+				log.Warning("[pulsarSubscription] the broker is unreachable:", err)
+				close(s.brokenCh)
+				return
+			}
+		case <-s.closeCh:
+			return
+		}
+	}
+}
+
+func (s *pulsarSubscription) receive() <-chan *receivedMessage {
+	return s.outCh
+}
+
+func (s *pulsarSubscription) broken() <-chan struct{} {
+	return s.brokenCh
+}
+
+func (s *pulsarSubscription) seek(start position) error {
+	if !start.publishTime.IsZero() {
+		return s.consumer.SeekByTime(start.publishTime)
+	}
+	id, err := start.messageID()
+	if err != nil {
+		return err
+	}
+	return s.consumer.Seek(id)
+}
+
+func (s *pulsarSubscription) unsubscribe() error {
+	return s.consumer.Unsubscribe()
+}
+
+func (s *pulsarSubscription) Close() {
+	close(s.closeCh)
+	s.consumer.Close()
+}
+
+type pulsarReader struct {
+	reader pulsar.Reader
+	codec  eventCodec
+}
+
+func (r *pulsarReader) hasNext() bool {
+	return r.reader.HasNext()
+}
+
+func (r *pulsarReader) next(ctx context.Context) (*receivedMessage, error) {
+	msg, err := r.reader.Next(ctx)
+	if err != nil {
+		return nil, err
+	}
+	actionMsg, err := r.codec.decode(msg.Payload())
+	if err != nil {
+		return nil, err
+	}
+	return newReceivedMessage(msg, actionMsg), nil
+}
+
+func (r *pulsarReader) Close() {
+	r.reader.Close()
+}
+
+func newReceivedMessage(msg pulsar.Message, actionMsg *EventMessage) *receivedMessage {
+	return &receivedMessage{
+		id:          msg.ID().Serialize(),
+		publishTime: msg.PublishTime(),
+		producer:    msg.ProducerName(),
+		event:       actionMsg,
+	}
+}
+
+func (c *pulsarClient) readLatestEvent(topicName string) Event {
+	transport := c.getTransport()
+	if transport == nil {
+		return nil
+	}
+	reader, err := transport.createReader(topicName, latestPosition)
 	if err != nil {
 		log.Error("[readLatestEvent]", err)
+		return nil
 	}
 	defer reader.Close()
 
-	if reader.HasNext() {
-		msg, err := reader.Next(context.Background())
+	if reader.hasNext() {
+		msg, err := reader.next(context.Background())
 		if err != nil {
 			log.Error("[readLatestEvent]", err)
+			return nil
 		}
-		actionMsg := EventMessage{}
-
-		err = json.Unmarshal(msg.Payload(), &actionMsg)
-		return convertMsgToEvent(&actionMsg)
+		event, err := convertMsgToEvent(msg.event)
+		if err != nil {
+			log.Warning("[readLatestEvent]", err)
+			return nil
+		}
+		return event
 	}
 	return nil
 }
 
+// listenScores calls f when the score of a player changes, also after reconnecting
+func (c *pulsarClient) listenScores(f func(playerName, score string)) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.scoreListener = f
+	if c.transport == nil {
+		// connect listens to it on the new connection
+		return nil
+	}
+	return c.transport.listenTable(c.getScoreTopicName(), f)
+}
+
+// publishSnapshot sends the snapshot of the room in background
+func (c *pulsarClient) publishSnapshot(s *worldSnapshot) {
+	transport := c.getTransport()
+	if transport == nil {
+		return
+	}
+	go func() {
+		err := publishSnapshot(transport, c.roomName, s)
+		if err != nil {
+			log.Error("[publishSnapshot]", err)
+		}
+	}()
+}
+
 // start to receive message from pulsar, forwarding to receiveCh
-func (c *pulsarClient) start(in chan Event) chan Event {
+func (c *pulsarClient) start(in chan Event) chan *receivedMessage {
 	// All players' action can be received from this channel
-	outCh := make(chan Event)
+	outCh := make(chan *receivedMessage)
 	go func() {
 		for {
+			transport, subscription := c.connection()
+			if subscription == nil {
+				// left the room
+				return
+			}
 			select {
 			// receive message from pulsar, forwarding to outCh
-			case cm := <-c.consumeCh:
-				msg := cm.Message
-				if msg == nil {
-					log.Warning("receive a nil message")
+			case msg := <-subscription.receive():
+				if bytes.Equal(msg.id, c.lastMessageID) {
+					// the subscription resumes from the last message
 					break
 				}
-				actionMsg := EventMessage{}
-				err := msg.GetSchemaValue(&actionMsg)
-				if err != nil {
-					log.Error("[start]", err)
-					break
+				if c.isReplacedBy(msg.event) {
+					log.Warning("[pulsarClient] this player logged in again, leave the room")
+					c.leave()
+					return
+				}
+				c.lastMessageID = msg.id
+				c.stats.addReceived(time.Since(msg.publishTime))
+				select {
+				case outCh <- msg:
+				case <-c.closeCh:
+					return
+				}
+
+			case <-subscription.broken():
+				if !c.reconnect() {
+					return
 				}
-				l := math.Min(float64(len(msg.Payload())), 100)
-				log.Info("receive message from pulsar:\n", string(msg.Payload())[:int(l)])
-				cm.Ack(msg)
-				outCh <- convertMsgToEvent(&actionMsg)
 
 			// need to send message to pulsar
 			case action := <-in:
@@ -283,14 +775,21 @@ func (c *pulsarClient) start(in chan Event) chan Event {
 					break
 				}
 				actionMsg := convertEventToMsg(action)
-				_, err := c.producer.Send(context.Background(), &pulsar.ProducerMessage{
-					Value: actionMsg,
-				})
+				if actionMsg.Tick == 0 {
+					// the event happens now
+					actionMsg.Tick = roomTick(time.Now())
+				}
+				_, err := transport.publish(c.getEventTopicName(), "", actionMsg)
 				if err != nil {
 					log.Error("send msg failed:", err)
+					c.stats.addDropped()
+					if !c.reconnect() {
+						return
+					}
 					break
 				}
-				//log.Info("send message to pulsar:\n", string(bytes))
+				c.backoff = 0
+				c.stats.addSent()
 
 			case <-c.closeCh:
 				return
@@ -325,13 +824,15 @@ func convertEventToMsg(action Event) *EventMessage {
 		}
 	case *UserDeadEvent:
 		msg = &EventMessage{
-			Type:   UserDeadEventType,
-			Name:   t.name,
-			Avatar: t.avatar,
-			X:      t.pos.X,
-			Y:      t.pos.Y,
-			// record the killer player name
+			Type:    UserDeadEventType,
+			Version: 2,
+			Name:    t.name,
+			Avatar:  t.avatar,
+			X:       t.pos.X,
+			Y:       t.pos.Y,
+			// the score function and version 1 read the killer in Comment
 			Comment: t.killer,
+			Payload: encodePayload(&userDeadPayload{Killer: t.killer}),
 			Alive:   false,
 		}
 	case *UserReviveEvent:
@@ -375,62 +876,52 @@ func convertEventToMsg(action Event) *EventMessage {
 			Type: UpdateObstacleEventType,
 			List: t.Obstacles,
 		}
-	}
-	return msg
-}
-
-func convertMsgToEvent(msg *EventMessage) Event {
-	info := &playerInfo{
-		name:   msg.Name,
-		avatar: msg.Avatar,
-		pos: Position{
-			X: msg.X,
-			Y: msg.Y,
-		},
-		alive: msg.Alive,
-	}
-	switch msg.Type {
-	case UserJoinEventType:
-		return &UserJoinEvent{
-			playerInfo: info,
-			Obstacles:  msg.List,
-		}
-	case SetBombEventType:
-		return &SetBombEvent{
-			bombName: msg.Name,
-			pos:      info.pos,
+		if t.gameMap != nil || t.seed != 0 {
+			// version 1 plays the obstacles as a random map
+			msg.Version = 2
+			msg.Payload = encodePayload(&updateMapPayload{Map: t.gameMap, Seed: t.seed})
 		}
-	case MoveBombEventType:
-		return &BombMoveEvent{
-			bombName: msg.Name,
-			pos:      info.pos,
+	case *PowerUpSpawnEvent:
+		msg = &EventMessage{
+			Type:    PowerUpSpawnEventType,
+			X:       t.pos.X,
+			Y:       t.pos.Y,
+			Payload: encodePayload(&powerUpPayload{Kind: t.kind}),
 		}
-	case UserMoveEventType:
-		return &UserMoveEvent{
-			playerInfo: info,
+	case *PowerUpCollectEvent:
+		msg = &EventMessage{
+			Type:    PowerUpCollectEventType,
+			Name:    t.name,
+			X:       t.pos.X,
+			Y:       t.pos.Y,
+			Payload: encodePayload(&powerUpPayload{Kind: t.kind}),
 		}
-	case UserDeadEventType:
-		return &UserDeadEvent{
-			playerInfo: info,
-			killer:     msg.Comment,
+	case *StateHashEvent:
+		msg = &EventMessage{
+			Type:    StateHashEventType,
+			Name:    t.name,
+			Payload: encodePayload(&stateHashPayload{Hash: t.hash, MessageID: t.messageID}),
 		}
-	case UserReviveEventType:
-		return &UserReviveEvent{
-			playerInfo: info,
+	case *SessionTakeoverEvent:
+		msg = &EventMessage{
+			Type:    TakeoverEventType,
+			Name:    t.name,
+			Payload: encodePayload(&takeoverPayload{TokenHash: t.tokenHash}),
 		}
-	case ExplodeEventType:
-		return &ExplodeEvent{
-			bombName: msg.Name,
-			pos:      info.pos,
+	case *RoomHostedEvent:
+		msg = &EventMessage{
+			Type: RoomHostedEventType,
 		}
-	case UndoExplodeEventType:
-		return &UndoExplodeEvent{
-			pos: info.pos,
+	case *RoomUnhostedEvent:
+		msg = &EventMessage{
+			Type: RoomUnhostedEventType,
 		}
-	case UpdateObstacleEventType:
-		return &UpdateMapEvent{
-			Obstacles: msg.List,
+	}
+	if msg != nil {
+		msg.Tick = action.header().tick
+		if msg.Version == 0 {
+			msg.Version = 1
 		}
 	}
-	return nil
+	return msg
 }
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// the random bombs are named randomBombOwner-xxxxx, no player owns them
+const randomBombOwner = "random"
+
+// randomBombSettings is how random bombs appear in a room. Only the room
+// server, or the leader of a room without server, spawns them, so their
+// number doesn't grow with the players.
+type randomBombSettings struct {
+	// a random bomb appears every interval, 0 disables them
+	Interval time.Duration `yaml:"interval" json:"interval"`
+	// the most random bombs on the map at the same time, 0 is unlimited
+	Max int `yaml:"max" json:"max"`
+	// the areas where random bombs appear more or less often, the grids
+	// out of them weigh 1
+	Areas []bombArea `yaml:"areas" json:"areas"`
+}
+
+// bombArea weighs the grids of a rectangle, a grid in several areas takes
+// the weight of the last one, 0 keeps random bombs out of the area
+type bombArea struct {
+	X      int `yaml:"x" json:"x"`
+	Y      int `yaml:"y" json:"y"`
+	Width  int `yaml:"width" json:"width"`
+	Height int `yaml:"height" json:"height"`
+	Weight int `yaml:"weight" json:"weight"`
+}
+
+var defaultRandomBombSettings = randomBombSettings{
+	Interval: 2 * time.Second,
+	Max:      5,
+}
+
+func (a *bombArea) contains(pos Position) bool {
+	return pos.X >= a.X && pos.X < a.X+a.Width && pos.Y >= a.Y && pos.Y < a.Y+a.Height
+}
+
+// weight is how often a random bomb appears on the grid relative to others
+func (s *randomBombSettings) weight(pos Position) int {
+	weight := 1
+	for i := range s.Areas {
+		if s.Areas[i].contains(pos) {
+			weight = s.Areas[i].Weight
+		}
+	}
+	return weight
+}
+
+// genRandomBomb picks a free grid by the weights of the areas, it returns
+// nil if the map is full of random bombs or has no free grid
+func (w *World) genRandomBomb() *SetBombEvent {
+	settings := &w.settings.RandomBombs
+	if settings.Max > 0 && w.countBombs(randomBombOwner) >= settings.Max {
+		return nil
+	}
+	var grids []Position
+	var weights []int
+	total := 0
+	for x := 0; x < w.settings.Width; x++ {
+		for y := 0; y < w.settings.Height; y++ {
+			pos := Position{X: x, Y: y}
+			if _, ok := w.obstacleMap[pos]; ok {
+				continue
+			}
+			if _, ok := w.posToBombs[pos]; ok {
+				continue
+			}
+			weight := settings.weight(pos)
+			if weight <= 0 {
+				continue
+			}
+			grids = append(grids, pos)
+			weights = append(weights, weight)
+			total += weight
+		}
+	}
+	if total == 0 {
+		return nil
+	}
+	r := rand.Intn(total)
+	for i, weight := range weights {
+		if r < weight {
+			return &SetBombEvent{
+				bombName: randomBombOwner + "-" + randStringRunes(5),
+				pos:      grids[i],
+			}
+		}
+		r -= weight
+	}
+	return nil
+}
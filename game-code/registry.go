@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"sync"
+)
+
+// eventDecoder creates the event of one version of an event type
+type eventDecoder func(msg *EventMessage) (Event, error)
+
+// eventDecoders maps event type and version to the decoder. A new version
+// may only add data, the other fields of EventMessage keep their meaning,
+// so a message newer than all the known versions is decoded by the latest
+// known one. The clients skip the event types they don't know.
+var eventDecoders = map[string]map[int]eventDecoder{}
+
+var (
+	skippedEventsLock sync.Mutex
+	// warn once for every unknown event type
+	skippedEvents = map[string]bool{}
+)
+
+func registerEvent(eventType string, version int, decoder eventDecoder) {
+	if eventDecoders[eventType] == nil {
+		eventDecoders[eventType] = map[int]eventDecoder{}
+	}
+	eventDecoders[eventType][version] = decoder
+}
+
+// errUnknownEvent means the event is from a newer client, skip it
+type errUnknownEvent struct {
+	eventType string
+	version   int
+}
+
+func (e *errUnknownEvent) Error() string {
+	return fmt.Sprintf("unknown event %s version %d", e.eventType, e.version)
+}
+
+// convertMsgToEvent decodes the message by the registered decoders
+func convertMsgToEvent(msg *EventMessage) (Event, error) {
+	if msg == nil {
+		return nil, fmt.Errorf("nil message")
+	}
+	version := msg.Version
+	if version == 0 {
+		// sent before the versions
+		version = 1
+	}
+	decoder := findDecoder(msg.Type, version)
+	if decoder == nil {
+		return nil, &errUnknownEvent{eventType: msg.Type, version: version}
+	}
+	event, err := decoder(msg)
+	if err != nil {
+		return nil, err
+	}
+	event.header().tick = msg.Tick
+	return event, nil
+}
+
+// maxTickSkew is how far the tick stamped by the sender may be from the
+// publish time of its message
+const maxTickSkew = ticksPerSecond
+
+// receivedEvent decodes the received message. The tick stamped by the
+// sender is moved into maxTickSkew around the publish time, which every
+// receiver reads the same, so a wrong clock or a forged tick can't move
+// the room clock far.
+func receivedEvent(msg *receivedMessage) (Event, error) {
+	event, err := convertMsgToEvent(msg.event)
+	if err != nil {
+		return nil, err
+	}
+	h := event.header()
+	if h.tick == 0 || msg.publishTime.IsZero() {
+		// sent before the events carried a tick
+		return event, nil
+	}
+	published := roomTick(msg.publishTime)
+	if h.tick > published+maxTickSkew {
+		h.tick = published + maxTickSkew
+	} else if h.tick < published-maxTickSkew {
+		h.tick = published - maxTickSkew
+	}
+	return event, nil
+}
+
+// findDecoder returns the decoder of the version, or the latest version before it
+func findDecoder(eventType string, version int) eventDecoder {
+	decoders := eventDecoders[eventType]
+	if decoder, ok := decoders[version]; ok {
+		return decoder
+	}
+	var versions []int
+	for v := range decoders {
+		if v < version {
+			versions = append(versions, v)
+		}
+	}
+	if len(versions) == 0 {
+		return nil
+	}
+	sort.Ints(versions)
+	return decoders[versions[len(versions)-1]]
+}
+
+// skipEvent logs the message which can't be decoded, an unknown event type
+// is only logged once
+func skipEvent(tag string, msg *EventMessage, err error) {
+	if unknown, ok := err.(*errUnknownEvent); ok {
+		key := fmt.Sprintf("%s/%d", unknown.eventType, unknown.version)
+		skippedEventsLock.Lock()
+		defer skippedEventsLock.Unlock()
+		if skippedEvents[key] {
+			return
+		}
+		skippedEvents[key] = true
+		log.Warningf("[%s] skip %v, maybe it's from a newer client", tag, err)
+		return
+	}
+	log.Errorf("[%s] skip %+v: %v", tag, msg, err)
+}
+
+func encodePayload(payload interface{}) string {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		log.Error("[encodePayload]", err)
+		return ""
+	}
+	return string(data)
+}
+
+func decodePayload(msg *EventMessage, payload interface{}) error {
+	if msg.Payload == "" {
+		return fmt.Errorf("%s version %d has no payload", msg.Type, msg.Version)
+	}
+	return json.Unmarshal([]byte(msg.Payload), payload)
+}
+
+// userDeadPayload is the payload of UserDeadEvent since version 2
+type userDeadPayload struct {
+	Killer string `json:"killer"`
+}
+
+// updateMapPayload is the payload of UpdateMapEvent since version 2
+type updateMapPayload struct {
+	Map  *gameMap `json:"map"`
+	Seed int64    `json:"seed"`
+}
+
+// powerUpPayload is the payload of PowerUpSpawnEvent and PowerUpCollectEvent
+type powerUpPayload struct {
+	Kind powerUpKind `json:"kind"`
+}
+
+// stateHashPayload is the payload of StateHashEvent
+type stateHashPayload struct {
+	Hash      string `json:"hash"`
+	MessageID []byte `json:"messageId"`
+}
+
+// takeoverPayload is the payload of SessionTakeoverEvent
+type takeoverPayload struct {
+	TokenHash string `json:"tokenHash"`
+}
+
+func msgPlayerInfo(msg *EventMessage) *playerInfo {
+	return &playerInfo{
+		name:   msg.Name,
+		avatar: msg.Avatar,
+		pos: Position{
+			X: msg.X,
+			Y: msg.Y,
+		},
+		alive: msg.Alive,
+	}
+}
+
+func init() {
+	registerEvent(UserJoinEventType, 1, func(msg *EventMessage) (Event, error) {
+		return &UserJoinEvent{
+			playerInfo: msgPlayerInfo(msg),
+			Obstacles:  msg.List,
+		}, nil
+	})
+	registerEvent(SetBombEventType, 1, func(msg *EventMessage) (Event, error) {
+		return &SetBombEvent{
+			bombName: msg.Name,
+			pos:      Position{X: msg.X, Y: msg.Y},
+		}, nil
+	})
+	registerEvent(MoveBombEventType, 1, func(msg *EventMessage) (Event, error) {
+		return &BombMoveEvent{
+			bombName: msg.Name,
+			pos:      Position{X: msg.X, Y: msg.Y},
+		}, nil
+	})
+	registerEvent(UserMoveEventType, 1, func(msg *EventMessage) (Event, error) {
+		return &UserMoveEvent{
+			playerInfo: msgPlayerInfo(msg),
+		}, nil
+	})
+	registerEvent(UserDeadEventType, 1, func(msg *EventMessage) (Event, error) {
+		return &UserDeadEvent{
+			playerInfo: msgPlayerInfo(msg),
+			killer:     msg.Comment,
+		}, nil
+	})
+	registerEvent(UserDeadEventType, 2, func(msg *EventMessage) (Event, error) {
+		payload := &userDeadPayload{}
+		if err := decodePayload(msg, payload); err != nil {
+			return nil, err
+		}
+		return &UserDeadEvent{
+			playerInfo: msgPlayerInfo(msg),
+			killer:     payload.Killer,
+		}, nil
+	})
+	registerEvent(UserReviveEventType, 1, func(msg *EventMessage) (Event, error) {
+		return &UserReviveEvent{
+			playerInfo: msgPlayerInfo(msg),
+		}, nil
+	})
+	registerEvent(ExplodeEventType, 1, func(msg *EventMessage) (Event, error) {
+		return &ExplodeEvent{
+			bombName: msg.Name,
+			pos:      Position{X: msg.X, Y: msg.Y},
+		}, nil
+	})
+	registerEvent(UndoExplodeEventType, 1, func(msg *EventMessage) (Event, error) {
+		return &UndoExplodeEvent{
+			pos: Position{X: msg.X, Y: msg.Y},
+		}, nil
+	})
+	registerEvent(UpdateObstacleEventType, 1, func(msg *EventMessage) (Event, error) {
+		return &UpdateMapEvent{
+			Obstacles: msg.List,
+		}, nil
+	})
+	registerEvent(UpdateObstacleEventType, 2, func(msg *EventMessage) (Event, error) {
+		payload := &updateMapPayload{}
+		if err := decodePayload(msg, payload); err != nil {
+			return nil, err
+		}
+		if payload.Map != nil {
+			if err := payload.Map.validate(); err != nil {
+				return nil, fmt.Errorf("invalid map %s: %w", payload.Map.Name, err)
+			}
+		}
+		return &UpdateMapEvent{
+			Obstacles: msg.List,
+			gameMap:   payload.Map,
+			seed:      payload.Seed,
+		}, nil
+	})
+	registerEvent(PowerUpSpawnEventType, 1, func(msg *EventMessage) (Event, error) {
+		payload := &powerUpPayload{}
+		if err := decodePayload(msg, payload); err != nil {
+			return nil, err
+		}
+		return &PowerUpSpawnEvent{
+			pos:  Position{X: msg.X, Y: msg.Y},
+			kind: payload.Kind,
+		}, nil
+	})
+	registerEvent(PowerUpCollectEventType, 1, func(msg *EventMessage) (Event, error) {
+		payload := &powerUpPayload{}
+		if err := decodePayload(msg, payload); err != nil {
+			return nil, err
+		}
+		return &PowerUpCollectEvent{
+			name: msg.Name,
+			pos:  Position{X: msg.X, Y: msg.Y},
+			kind: payload.Kind,
+		}, nil
+	})
+	registerEvent(StateHashEventType, 1, func(msg *EventMessage) (Event, error) {
+		payload := &stateHashPayload{}
+		if err := decodePayload(msg, payload); err != nil {
+			return nil, err
+		}
+		return &StateHashEvent{
+			name:      msg.Name,
+			hash:      payload.Hash,
+			messageID: payload.MessageID,
+		}, nil
+	})
+	registerEvent(TakeoverEventType, 1, func(msg *EventMessage) (Event, error) {
+		payload := &takeoverPayload{}
+		if err := decodePayload(msg, payload); err != nil {
+			return nil, err
+		}
+		return &SessionTakeoverEvent{
+			name:      msg.Name,
+			tokenHash: payload.TokenHash,
+		}, nil
+	})
+	registerEvent(RoomHostedEventType, 1, func(msg *EventMessage) (Event, error) {
+		return &RoomHostedEvent{}, nil
+	})
+	registerEvent(RoomUnhostedEventType, 1, func(msg *EventMessage) (Event, error) {
+		return &RoomUnhostedEvent{}, nil
+	})
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestConvertMsgToEvent(t *testing.T) {
+	killedBy := func(killer string) string {
+		return encodePayload(&userDeadPayload{Killer: killer})
+	}
+	tests := []struct {
+		name string
+		msg  *EventMessage
+		// the killer of the decoded UserDeadEvent
+		wantKiller  string
+		wantErr     bool
+		wantUnknown bool
+	}{
+		{name: "before the versions", msg: &EventMessage{Type: UserDeadEventType, Name: "bob", Comment: "ann"}, wantKiller: "ann"},
+		{name: "version 1", msg: &EventMessage{Type: UserDeadEventType, Name: "bob", Comment: "ann", Version: 1}, wantKiller: "ann"},
+		{name: "version 2", msg: &EventMessage{Type: UserDeadEventType, Name: "bob", Version: 2, Payload: killedBy("ann")}, wantKiller: "ann"},
+		{
+			// the fields of a newer version are only added
+			name:       "newer than known",
+			msg:        &EventMessage{Type: UserDeadEventType, Name: "bob", Version: 9, Payload: killedBy("ann")},
+			wantKiller: "ann",
+		},
+		{name: "version 2 without payload", msg: &EventMessage{Type: UserDeadEventType, Name: "bob", Version: 2}, wantErr: true},
+		{name: "unknown type", msg: &EventMessage{Type: "TeleportEvent"}, wantErr: true, wantUnknown: true},
+		{name: "nil", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event, err := convertMsgToEvent(tt.msg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("convertMsgToEvent returns %v, want error %v", err, tt.wantErr)
+			}
+			var unknown *errUnknownEvent
+			if errors.As(err, &unknown) != tt.wantUnknown {
+				t.Fatalf("convertMsgToEvent returns %v, want an unknown event %v", err, tt.wantUnknown)
+			}
+			if err != nil {
+				return
+			}
+			dead, ok := event.(*UserDeadEvent)
+			if !ok {
+				t.Fatalf("decoded %T, want *UserDeadEvent", event)
+			}
+			if dead.name != "bob" || dead.killer != tt.wantKiller {
+				t.Fatalf("%s killed by %s, want bob killed by %s", dead.name, dead.killer, tt.wantKiller)
+			}
+		})
+	}
+}
+
+func TestConvertEventRoundTrip(t *testing.T) {
+	events := []Event{
+		joinAt(1000, "ann", 3, 4),
+		moveTo(1001, "ann", 3, 5),
+		bombAt(1002, "ann-1", 3, 5),
+		&UserDeadEvent{eventHeader: eventHeader{tick: 1003}, playerInfo: &playerInfo{name: "bob"}, killer: "ann"},
+		&SessionTakeoverEvent{eventHeader: eventHeader{tick: 1004}, name: "ann", tokenHash: "hash"},
+	}
+	for _, e := range events {
+		msg := convertEventToMsg(e)
+		t.Run(msg.Type, func(t *testing.T) {
+			got, err := convertMsgToEvent(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if again := convertEventToMsg(got); !reflect.DeepEqual(again, msg) {
+				t.Fatalf("decoded %+v, want %+v", again, msg)
+			}
+		})
+	}
+}
+
+func TestReceivedEventBoundsTick(t *testing.T) {
+	published := time.UnixMilli(1000000)
+	room := roomTick(published)
+	tests := []struct {
+		name        string
+		tick        int64
+		publishTime time.Time
+		want        int64
+	}{
+		{name: "in time", tick: room - 5, publishTime: published, want: room - 5},
+		{name: "ahead", tick: room + 10*maxTickSkew, publishTime: published, want: room + maxTickSkew},
+		{name: "behind", tick: room - 10*maxTickSkew, publishTime: published, want: room - maxTickSkew},
+		{name: "without tick", publishTime: published},
+		{name: "without publish time", tick: 5, want: 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event, err := receivedEvent(&receivedMessage{
+				publishTime: tt.publishTime,
+				event:       &EventMessage{Type: UserMoveEventType, Name: "ann", Tick: tt.tick},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := event.header().tick; got != tt.want {
+				t.Fatalf("tick %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
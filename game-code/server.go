@@ -0,0 +1,381 @@
+package main
+
+import (
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// a running room server publishes RoomHostedEvent every
+	// hostedHeartbeatTime, the room is hosted until hostedLeaseTime after
+	// the last one, so a crashed server doesn't keep it forever
+	hostedHeartbeatTime = 5 * time.Second
+	hostedLeaseTime     = 3 * hostedHeartbeatTime
+)
+
+// roomServer owns one room. Players send their intents to the event topic,
+// the server validates them against its world and publishes the accepted
+// changes to the state topic, which is what the clients render.
+type roomServer struct {
+	roomName     string
+	transport    Transport
+	subscription eventSubscription
+	world        *World
+	settings     *roomSettings
+	// the id of the last message published to the state topic
+	lastMessageID []byte
+
+	lock sync.Mutex
+	// scores of every player, they're in the snapshots
+	scores  map[string]string
+	closeCh chan struct{}
+}
+
+func (s *roomServer) getEventTopicName() string {
+	return s.roomName + "-event-topic"
+}
+
+func (s *roomServer) getStateTopicName() string {
+	return s.roomName + "-state-topic"
+}
+
+// only one server can own the room
+func (s *roomServer) getServerSubscriptionName() string {
+	return s.roomName + "-server-sub"
+}
+
+func newRoomServer(roomName string) (*roomServer, error) {
+	transport, err := newTransport("")
+	if err != nil {
+		return nil, err
+	}
+	settings, roomMap, err := joinRoomSettings(transport, roomName)
+	if err != nil {
+		transport.Close()
+		return nil, err
+	}
+	if loadedMap != nil {
+		if err = loadedMap.checkRoom(settings); err != nil {
+			transport.Close()
+			return nil, err
+		}
+	}
+	s := &roomServer{
+		roomName:  roomName,
+		transport: transport,
+		world:     newWorld("", roleServer, settings),
+		settings:  settings,
+		scores:    map[string]string{},
+		closeCh:   make(chan struct{}),
+	}
+	subscription, err := transport.subscribe(s.getEventTopicName(), s.getServerSubscriptionName(), true)
+	if errors.Is(err, errExclusiveConsumerBusy) {
+		transport.Close()
+		return nil, errors.New("this room already has a server")
+	}
+	if err != nil {
+		transport.Close()
+		return nil, err
+	}
+	// only handle new intents
+	err = subscription.seek(latestPosition)
+	if err != nil {
+		subscription.Close()
+		transport.Close()
+		return nil, err
+	}
+	s.subscription = subscription
+
+	snapshot, err := readLatestSnapshot(transport, roomName, s.getStateTopicName())
+	if err != nil {
+		log.Warning("[roomServer] read snapshot failed:", err)
+	}
+	if snapshot != nil {
+		// take over the room from the last server
+		s.world.restore(snapshot)
+		s.lastMessageID = snapshot.MessageID
+	} else if roomMap != nil {
+		s.world.gameMap = roomMap
+		s.world.obstacleMap = s.settings.genObstacleMapFromList(roomMap.Obstacles, nil)
+	} else {
+		s.world.obstacleMap = s.settings.genObstacleMapFromList(s.world.genRandomObstacleList(s.settings.newMapSeed()), nil)
+	}
+
+	err = transport.listenTable(s.roomName+"-score-topic", func(playerName, score string) {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		s.scores[playerName] = score
+	})
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	// the dead events players send to the event topic aren't scored while
+	// the server renews the lease
+	id, err := transport.publish(s.getStateTopicName(), "", convertEventToMsg(&RoomHostedEvent{
+		eventHeader: eventHeader{tick: roomTick(time.Now())},
+	}))
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	s.lastMessageID = id
+	return s, nil
+}
+
+// run handles intents and drives the world until Close
+func (s *roomServer) run() {
+	ticker := time.NewTicker(time.Second / ticksPerSecond)
+	defer ticker.Stop()
+	mapTicker := time.NewTicker(s.settings.UpdateObstacleTime)
+	defer mapTicker.Stop()
+	snapshotTicker := time.NewTicker(time.Second * snapshotTime)
+	defer snapshotTicker.Stop()
+	hostedTicker := time.NewTicker(hostedHeartbeatTime)
+	defer hostedTicker.Stop()
+	var randomBombC <-chan time.Time
+	if s.settings.RandomBombs.Interval > 0 {
+		randomBombTicker := time.NewTicker(s.settings.RandomBombs.Interval)
+		defer randomBombTicker.Stop()
+		randomBombC = randomBombTicker.C
+	}
+	var powerUpC <-chan time.Time
+	if s.settings.PowerUps.SpawnInterval > 0 {
+		powerUpTicker := time.NewTicker(s.settings.PowerUps.SpawnInterval)
+		defer powerUpTicker.Stop()
+		powerUpC = powerUpTicker.C
+	}
+	if loadedMap != nil {
+		// the room plays the map file from now on
+		if err := publishRoomMap(s.transport, s.roomName, loadedMap); err != nil {
+			log.Error("[roomServer] publish map failed:", err)
+		}
+		s.step()
+		s.accept(loadedMap.updateEvent())
+	}
+	for {
+		select {
+		case msg := <-s.subscription.receive():
+			s.step()
+			event, err := receivedEvent(msg)
+			if err != nil {
+				skipEvent("roomServer", msg.event, err)
+				break
+			}
+			s.handleIntent(msg.producer, event)
+		case <-ticker.C:
+			s.step()
+		case <-mapTicker.C:
+			s.step()
+			if s.world.gameMap != nil {
+				s.accept(s.world.gameMap.updateEvent())
+				break
+			}
+			s.accept(s.world.genRandomMap())
+		case <-randomBombC:
+			s.step()
+			if bomb := s.world.genRandomBomb(); bomb != nil {
+				s.accept(bomb)
+			}
+		case <-powerUpC:
+			s.step()
+			if powerUp := s.world.genPowerUp(); powerUp != nil {
+				s.accept(powerUp)
+			}
+		case <-snapshotTicker.C:
+			s.publishSnapshot()
+		case <-hostedTicker.C:
+			// renew the lease of the room
+			s.publish(&RoomHostedEvent{eventHeader: eventHeader{tick: s.world.tick}})
+		case <-s.closeCh:
+			return
+		}
+	}
+}
+
+func (s *roomServer) Close() {
+	close(s.closeCh)
+	s.subscription.Close()
+	// the dead events players send to the event topic are scored again
+	_, err := s.transport.publish(s.getStateTopicName(), "", convertEventToMsg(&RoomUnhostedEvent{
+		eventHeader: eventHeader{tick: roomTick(time.Now())},
+	}))
+	if err != nil {
+		log.Warning("[roomServer] publish RoomUnhostedEvent failed:", err)
+	}
+	s.transport.Close()
+}
+
+// step moves the world to the room clock, and publishes the deaths
+func (s *roomServer) step() {
+	for _, event := range s.world.Step(roomTick(time.Now())) {
+		s.accept(event)
+	}
+}
+
+// accept applies the event to the world at the current tick, and publishes
+// it to the clients with the tick
+func (s *roomServer) accept(event Event) {
+	event.header().tick = s.world.tick
+	s.world.Apply(event)
+	s.publish(event)
+}
+
+// publish sends the event to the state topic as it is
+func (s *roomServer) publish(event Event) {
+	id, err := s.transport.publish(s.getStateTopicName(), "", convertEventToMsg(event))
+	if err != nil {
+		log.Error("[roomServer] publish failed:", err)
+		return
+	}
+	s.lastMessageID = id
+}
+
+// publishSnapshot publishes the world after the last accepted event
+func (s *roomServer) publishSnapshot() {
+	if s.lastMessageID == nil {
+		return
+	}
+	snapshot := s.world.snapshot()
+	snapshot.Topic = s.getStateTopicName()
+	snapshot.MessageID = s.lastMessageID
+	snapshot.Scores = map[string]string{}
+	s.lock.Lock()
+	for name, score := range s.scores {
+		snapshot.Scores[name] = score
+	}
+	s.lock.Unlock()
+	err := publishSnapshot(s.transport, s.roomName, snapshot)
+	if err != nil {
+		log.Error("[roomServer] publish snapshot failed:", err)
+	}
+}
+
+// handleIntent accepts the valid intent of a player. The clients publish
+// with their player names as producer names, a player's intents are taken
+// from its producer only.
+func (s *roomServer) handleIntent(producer string, event Event) {
+	w := s.world
+	switch e := event.(type) {
+	case *UserJoinEvent:
+		if e.name == "" || e.name != producer {
+			break
+		}
+		if player, ok := w.nameToPlayers[e.name]; ok {
+			// the player is in the room, the client joining again without
+			// it in a snapshot takes the player as the server has it
+			e.playerInfo = &playerInfo{
+				name:   player.name,
+				avatar: player.avatar,
+				pos:    player.pos,
+				alive:  player.alive,
+			}
+			e.Obstacles = w.settings.genListFromObstacleMap(w.obstacleMap)
+			s.accept(e)
+			return
+		}
+		if w.gameMap != nil {
+			e.pos = w.gameMap.pickSpawn(w)
+		} else {
+			e.pos = w.joinPos(e.pos)
+		}
+		// everyone shares the map of server
+		e.Obstacles = w.settings.genListFromObstacleMap(w.obstacleMap)
+		s.accept(e)
+		return
+
+	case *UserMoveEvent:
+		player, ok := w.nameToPlayers[e.name]
+		if e.name != producer || !ok || !player.alive || distance(player.pos, e.pos) != 1 {
+			break
+		}
+		if !w.canMove(player, e.pos) {
+			break
+		}
+		e.alive = true
+		s.accept(e)
+		return
+
+	case *SetBombEvent:
+		player, ok := w.nameToPlayers[strings.Split(e.bombName, "-")[0]]
+		if !ok || player.name != producer || !player.alive || player.pos != e.pos {
+			// random bombs are the server's, and players set bombs where they stand
+			break
+		}
+		if !w.canSetBomb(player.name, e.pos) {
+			break
+		}
+		s.accept(e)
+		return
+
+	case *UserReviveEvent:
+		player, ok := w.nameToPlayers[e.name]
+		if e.name != producer || !ok || player.alive {
+			break
+		}
+		e.pos = player.pos
+		if w.gameMap != nil {
+			e.pos = w.gameMap.pickSpawn(w)
+		}
+		s.accept(e)
+		return
+
+	case *StateHashEvent:
+		// the hash of a player is for the checker, keep its tick
+		if _, ok := w.nameToPlayers[e.name]; ok && e.name == producer {
+			s.publish(e)
+			return
+		}
+
+	case *SessionTakeoverEvent:
+		// the last session of the player receives the state topic only, it
+		// checks the token hash, and the new session can't publish with the
+		// producer name of the player until the last one leaves
+		if e.name != "" && producer == e.name+takeoverProducerSuffix {
+			s.publish(e)
+			return
+		}
+	}
+	// dead, explode, bomb move, map and power-up events are judged by the server only
+	log.Warningf("[roomServer] reject %T", event)
+}
+
+// joinPos returns pos if a new player can stand there, otherwise a random
+// grid without obstacles, bombs, flames and players
+func (w *World) joinPos(pos Position) Position {
+	free := func(p Position) bool {
+		if !w.settings.validCoordinate(p) {
+			return false
+		}
+		if _, ok := w.obstacleMap[p]; ok {
+			return false
+		}
+		if _, ok := w.posToBombs[p]; ok {
+			return false
+		}
+		if _, ok := w.flameMap[p]; ok {
+			return false
+		}
+		_, ok := w.posToPlayers[p]
+		return !ok
+	}
+	if free(pos) {
+		return pos
+	}
+	var grids []Position
+	for x := 0; x < w.settings.Width; x++ {
+		for y := 0; y < w.settings.Height; y++ {
+			if p := (Position{X: x, Y: y}); free(p) {
+				grids = append(grids, p)
+			}
+		}
+	}
+	if len(grids) == 0 {
+		return Position{}
+	}
+	return grids[rand.Intn(len(grids))]
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// newTestRoomServer starts a room server on the in-memory broker, the
+// test drives it by handleIntent instead of run
+func newTestRoomServer(t *testing.T) *roomServer {
+	t.Helper()
+	last := transportName
+	transportName = memoryTransportName
+	t.Cleanup(func() { transportName = last })
+	s, err := newRoomServer("server-test-" + randStringRunes(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	// the tests place the players, an empty map doesn't move them
+	s.world.obstacleMap = map[Position]ObstacleType{}
+	return s
+}
+
+// stateEvents returns the events the server published to the state topic
+func stateEvents(t *testing.T, s *roomServer) []*EventMessage {
+	t.Helper()
+	reader, err := s.transport.createReader(s.getStateTopicName(), earliestPosition)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	var events []*EventMessage
+	for reader.hasNext() {
+		msg, err := reader.next(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, msg.event)
+	}
+	return events
+}
+
+func TestRoomServerHandleIntent(t *testing.T) {
+	type intent struct {
+		producer string
+		event    Event
+	}
+	tests := []struct {
+		name    string
+		intents []intent
+		// the type of the last event in the state topic, and where the
+		// players are in the world of the server
+		wantLast string
+		// where the last event puts its player, if it's set
+		lastAt *Position
+		want   map[string]Position
+	}{
+		{
+			name:     "join",
+			intents:  []intent{{"ann", joinAt(0, "ann", 3, 3)}},
+			wantLast: UserJoinEventType,
+			want:     map[string]Position{"ann": {X: 3, Y: 3}},
+		},
+		{
+			name:     "join as another player",
+			intents:  []intent{{"bob", joinAt(0, "ann", 3, 3)}},
+			wantLast: RoomHostedEventType,
+			want:     map[string]Position{},
+		},
+		{
+			name: "join again",
+			intents: []intent{
+				{"ann", joinAt(0, "ann", 3, 3)},
+				{"ann", moveTo(0, "ann", 3, 4)},
+				// without a snapshot the client picked another grid
+				{"ann", joinAt(0, "ann", 7, 7)},
+			},
+			wantLast: UserJoinEventType,
+			lastAt:   &Position{X: 3, Y: 4},
+			want:     map[string]Position{"ann": {X: 3, Y: 4}},
+		},
+		{
+			name: "move",
+			intents: []intent{
+				{"ann", joinAt(0, "ann", 3, 3)},
+				{"ann", moveTo(0, "ann", 4, 3)},
+			},
+			wantLast: UserMoveEventType,
+			want:     map[string]Position{"ann": {X: 4, Y: 3}},
+		},
+		{
+			name: "move more than a grid",
+			intents: []intent{
+				{"ann", joinAt(0, "ann", 3, 3)},
+				{"ann", moveTo(0, "ann", 5, 3)},
+			},
+			wantLast: UserJoinEventType,
+			want:     map[string]Position{"ann": {X: 3, Y: 3}},
+		},
+		{
+			name: "move another player",
+			intents: []intent{
+				{"ann", joinAt(0, "ann", 3, 3)},
+				{"bob", moveTo(0, "ann", 4, 3)},
+			},
+			wantLast: UserJoinEventType,
+			want:     map[string]Position{"ann": {X: 3, Y: 3}},
+		},
+		{
+			name: "bomb",
+			intents: []intent{
+				{"ann", joinAt(0, "ann", 3, 3)},
+				{"ann", bombAt(0, "ann-1", 3, 3)},
+			},
+			wantLast: SetBombEventType,
+			want:     map[string]Position{"ann": {X: 3, Y: 3}},
+		},
+		{
+			name: "bomb of another player",
+			intents: []intent{
+				{"ann", joinAt(0, "ann", 3, 3)},
+				{"bob", bombAt(0, "ann-1", 3, 3)},
+			},
+			wantLast: UserJoinEventType,
+			want:     map[string]Position{"ann": {X: 3, Y: 3}},
+		},
+		{
+			name: "takeover",
+			intents: []intent{
+				{"ann", joinAt(0, "ann", 3, 3)},
+				{"ann#takeover", &SessionTakeoverEvent{name: "ann", tokenHash: "hash"}},
+			},
+			wantLast: TakeoverEventType,
+			want:     map[string]Position{"ann": {X: 3, Y: 3}},
+		},
+		{
+			name: "takeover of another player",
+			intents: []intent{
+				{"ann", joinAt(0, "ann", 3, 3)},
+				{"bob", &SessionTakeoverEvent{name: "ann", tokenHash: "hash"}},
+				{"bob#takeover", &SessionTakeoverEvent{name: "ann", tokenHash: "hash"}},
+			},
+			wantLast: UserJoinEventType,
+			want:     map[string]Position{"ann": {X: 3, Y: 3}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestRoomServer(t)
+			for _, in := range tt.intents {
+				s.handleIntent(in.producer, in.event)
+			}
+			events := stateEvents(t, s)
+			last := events[len(events)-1]
+			if last.Type != tt.wantLast {
+				t.Fatalf("the last event is %s, want %s", last.Type, tt.wantLast)
+			}
+			if len(s.world.nameToPlayers) != len(tt.want) {
+				t.Fatalf("%d players, want %d", len(s.world.nameToPlayers), len(tt.want))
+			}
+			for name, pos := range tt.want {
+				player, ok := s.world.nameToPlayers[name]
+				if !ok || player.pos != pos {
+					t.Fatalf("%s isn't at %v", name, pos)
+				}
+			}
+			if tt.lastAt != nil && (Position{X: last.X, Y: last.Y}) != *tt.lastAt {
+				t.Fatalf("the last event is at %d,%d, want %v", last.X, last.Y, *tt.lastAt)
+			}
+		})
+	}
+}
+
+func TestScoreboardHostedLease(t *testing.T) {
+	start := time.Now()
+	hosted := &EventMessage{Type: RoomHostedEventType}
+	unhosted := &EventMessage{Type: RoomUnhostedEventType}
+	dead := &EventMessage{Type: UserDeadEventType, Name: "bob", Comment: "ann"}
+	type message struct {
+		topic string
+		after time.Duration
+		event *EventMessage
+	}
+	tests := []struct {
+		name     string
+		messages []message
+		// the score of ann
+		want string
+	}{
+		{
+			name:     "without server",
+			messages: []message{{"room-event-topic", 0, dead}},
+			want:     "1",
+		},
+		{
+			name: "hosted",
+			messages: []message{
+				{"room-state-topic", 0, hosted},
+				{"room-event-topic", time.Second, dead},
+			},
+		},
+		{
+			name: "the state topic of a hosted room",
+			messages: []message{
+				{"room-state-topic", 0, hosted},
+				{"room-state-topic", time.Second, dead},
+			},
+			want: "1",
+		},
+		{
+			name: "the lease expired",
+			messages: []message{
+				{"room-state-topic", 0, hosted},
+				{"room-event-topic", hostedLeaseTime + time.Second, dead},
+			},
+			want: "1",
+		},
+		{
+			name: "the lease renewed",
+			messages: []message{
+				{"room-state-topic", 0, hosted},
+				{"room-state-topic", hostedHeartbeatTime, hosted},
+				{"room-event-topic", hostedLeaseTime + time.Second, dead},
+			},
+		},
+		{
+			name: "unhosted",
+			messages: []message{
+				{"room-state-topic", 0, hosted},
+				{"room-state-topic", time.Second, unhosted},
+				{"room-event-topic", 2 * time.Second, dead},
+			},
+			want: "1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newMemoryBroker()
+			f := scoreboardFunction()
+			for _, m := range tt.messages {
+				f(b, m.topic, &brokerMessage{publishTime: start.Add(m.after), event: m.event})
+			}
+			got := ""
+			b.listenTable("room-score-topic", func(key, value string) {
+				if key == "ann" {
+					got = value
+				}
+			})
+			if got != tt.want {
+				t.Fatalf("ann scores %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	lru "github.com/hashicorp/golang-lru"
+	log "github.com/sirupsen/logrus"
+	"math/rand"
+	"time"
+)
+
+// gameSession is a player in a room without window or audio, BombGame
+// draws it for a human and bots play it by strategies
+type gameSession struct {
+	// scores of every player
+	scores *lru.Cache
+
+	// the state of room
+	world *World
+
+	// receive event to redraw our game
+	receiveCh chan *receivedMessage
+	// send local event to send to pulsar
+	sendCh chan Event
+	// notified when this client should send a new map
+	mapUpdateCh chan struct{}
+	// notified when this client should publish a snapshot
+	snapshotCh chan struct{}
+	// notified when this client should set a random bomb
+	randomBombCh chan struct{}
+	// notified when this client should spawn a power-up
+	powerUpCh chan struct{}
+
+	client *pulsarClient
+	// elects the client updating the map of a room without server
+	elector  *leaderElector
+	settings *roomSettings
+
+	// the local moves sent but not applied yet, the local player is drawn
+	// at the last one before the world has it
+	pending  []pendingMove
+	moveTime time.Time
+	// the received events the world hasn't reached, they're reconciled at
+	// their ticks
+	arriving []Event
+}
+
+// playerName will be the subscription name
+// roomName will be the topic name
+// authoritative means the room is hosted by a room server, the session
+// sends intents to the server and follows what the server accepted
+func newGameSession(playerName, roomName string, authoritative bool) (*gameSession, error) {
+	client, err := newPulsarClient(roomName, playerName, authoritative)
+	if err != nil {
+		return nil, err
+	}
+	info := &playerInfo{
+		name:   playerName,
+		avatar: "fff",
+		pos: Position{
+			X: rand.Intn(client.settings.Width),
+			Y: rand.Intn(client.settings.Height),
+		},
+		alive: true,
+	}
+	role := roleClient
+	if authoritative {
+		// the server drives bombs and judges deaths
+		role = roleObserver
+	}
+	cache, err := lru.New(5)
+	s := &gameSession{
+		scores:       cache,
+		world:        newWorld(playerName, role, client.settings),
+		mapUpdateCh:  make(chan struct{}, 1),
+		snapshotCh:   make(chan struct{}, 1),
+		randomBombCh: make(chan struct{}, 1),
+		powerUpCh:    make(chan struct{}, 1),
+		client:       client,
+		settings:     client.settings,
+	}
+	// every client hashes its world, the checker finds who diverged
+	s.world.hashTicks = stateHashTicks
+	if client.snapshot != nil {
+		// start from the room as it is, not an empty world
+		s.world.restore(client.snapshot)
+		for name, score := range client.snapshot.Scores {
+			s.scores.Add(name, score)
+		}
+	} else {
+		s.world.gameMap = client.roomMap
+	}
+
+	// pulsar tableview update scores of every player
+	err = client.listenScores(func(playerName, score string) {
+		s.scores.Add(playerName, score)
+	})
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	// the map file of the room, or the one this client brings to the room
+	gameMap := s.world.gameMap
+	publishMap := loadedMap != nil && !authoritative
+	if publishMap {
+		err = loadedMap.checkRoom(s.settings)
+		if err == nil {
+			err = publishRoomMap(client.getTransport(), roomName, loadedMap)
+		}
+		if err != nil {
+			client.Close()
+			return nil, err
+		}
+		gameMap = loadedMap
+	}
+	if gameMap != nil {
+		info.pos = gameMap.pickSpawn(s.world)
+	}
+
+	// the room server keeps the player of the last session, it doesn't join again
+	resume := authoritative && s.world.localPlayer() != nil
+	if !resume {
+		// init local player
+		s.world.nameToPlayers[info.name] = info
+		s.world.posToPlayers[info.pos] = info
+	}
+
+	// use this channel to send to pulsar
+	s.sendCh = make(chan Event, 50)
+	// use this channel to receive from pulsar
+	s.receiveCh = s.client.start(s.sendCh)
+	if publishMap {
+		s.sendAsync(loadedMap.updateEvent())
+	}
+	if !resume {
+		s.join(gameMap)
+	}
+
+	if authoritative {
+		// the room server updates the map
+		return s, nil
+	}
+	// the sessions of a player taking over each other are different candidates
+	s.elector = newLeaderElector(roomName, playerName+"#"+randStringRunes(4))
+
+	// handle obstacle update and snapshot
+	go func() {
+		mapTicker := time.NewTicker(s.settings.UpdateObstacleTime)
+		defer mapTicker.Stop()
+		snapshotTicker := time.NewTicker(time.Second * snapshotTime)
+		defer snapshotTicker.Stop()
+		var randomBombC <-chan time.Time
+		if s.settings.RandomBombs.Interval > 0 {
+			randomBombTicker := time.NewTicker(s.settings.RandomBombs.Interval)
+			defer randomBombTicker.Stop()
+			randomBombC = randomBombTicker.C
+		}
+		var powerUpC <-chan time.Time
+		if s.settings.PowerUps.SpawnInterval > 0 {
+			powerUpTicker := time.NewTicker(s.settings.PowerUps.SpawnInterval)
+			defer powerUpTicker.Stop()
+			powerUpC = powerUpTicker.C
+		}
+		for {
+			select {
+			case <-mapTicker.C:
+				// the leader updates random obstacle
+				if s.elector.isLeader() {
+					// the map is generated in step, where the world is safe to read
+					select {
+					case s.mapUpdateCh <- struct{}{}:
+					default:
+					}
+				}
+			case <-snapshotTicker.C:
+				// the leader also publishes snapshots
+				if s.elector.isLeader() {
+					select {
+					case s.snapshotCh <- struct{}{}:
+					default:
+					}
+				}
+			case <-randomBombC:
+				// and sets the random bombs of the room
+				if s.elector.isLeader() {
+					select {
+					case s.randomBombCh <- struct{}{}:
+					default:
+					}
+				}
+			case <-powerUpC:
+				// and the power-ups on the cells of the map file
+				if s.elector.isLeader() {
+					select {
+					case s.powerUpCh <- struct{}{}:
+					default:
+					}
+				}
+			case <-s.client.closeCh:
+				return
+			}
+		}
+	}()
+
+	return s, nil
+}
+
+func (s *gameSession) Close() {
+	if s.elector != nil {
+		// hand over the room before leaving
+		s.elector.Close()
+	}
+	s.client.Close()
+	close(s.sendCh)
+}
+
+// step applies the received events to the world, moves its logical clock
+// and sends the events produced by the world
+func (s *gameSession) step() {
+	if s.elector != nil {
+		// the lease of the leader is extended while this loop runs
+		s.elector.served()
+	}
+	// listen to event
+	for received := true; received; {
+		select {
+		case msg := <-s.receiveCh:
+			event, err := receivedEvent(msg)
+			if err != nil {
+				s.world.messageID = msg.id
+				skipEvent("gameSession", msg.event, err)
+				break
+			}
+			s.world.Apply(event)
+			s.world.messageID = msg.id
+			s.arriving = append(s.arriving, event)
+		default:
+			received = false
+		}
+	}
+
+	if len(s.pending) > 0 && time.Since(s.pending[0].sent) > moveTimeout {
+		// lost or rejected by the room server
+		s.pending = nil
+	}
+
+	for _, event := range s.world.Step(roomTick(time.Now()) - inputDelayTicks) {
+		s.sendAsync(event)
+	}
+	arriving := s.arriving[:0]
+	for _, event := range s.arriving {
+		if event.header().tick > s.world.tick {
+			arriving = append(arriving, event)
+			continue
+		}
+		s.reconcile(event)
+	}
+	s.arriving = arriving
+
+	select {
+	case <-s.mapUpdateCh:
+		if s.world.gameMap != nil {
+			// the map file of the room is reset
+			s.sendAsync(s.world.gameMap.updateEvent())
+			break
+		}
+		s.sendAsync(s.world.genRandomMap())
+	default:
+	}
+
+	select {
+	case <-s.randomBombCh:
+		if bomb := s.world.genRandomBomb(); bomb != nil {
+			s.sendAsync(bomb)
+		}
+	default:
+	}
+
+	select {
+	case <-s.powerUpCh:
+		if powerUp := s.world.genPowerUp(); powerUp != nil {
+			s.sendAsync(powerUp)
+		}
+	default:
+	}
+
+	select {
+	case <-s.snapshotCh:
+		s.publishSnapshot()
+	default:
+	}
+}
+
+// publishSnapshot publishes the world with scores, new players start from it
+func (s *gameSession) publishSnapshot() {
+	if s.world.messageID == nil {
+		// nothing has been applied yet
+		return
+	}
+	if len(s.world.pending) > 0 {
+		// the events waiting for their ticks aren't in a snapshot, wait for
+		// the next one
+		return
+	}
+	snapshot := s.world.snapshot()
+	snapshot.Topic = s.client.getReceiveTopicName()
+	snapshot.MessageID = s.world.messageID
+	snapshot.Scores = map[string]string{}
+	for _, k := range s.scores.Keys() {
+		if score, ok := s.scores.Get(k); ok {
+			snapshot.Scores[k.(string)] = score.(string)
+		}
+	}
+	s.client.publishSnapshot(snapshot)
+}
+
+// localPlayerInfo copies the local player, events carry the copy
+func (s *gameSession) localPlayerInfo() *playerInfo {
+	localPlayer := s.world.localPlayer()
+	return &playerInfo{
+		name:   localPlayer.name,
+		pos:    localPlayer.pos,
+		avatar: localPlayer.avatar,
+		alive:  localPlayer.alive,
+	}
+}
+
+// move the local player, the bomb in the way will be pushed with kick. It
+// moves at most a grid every moveInterval at the speed of the player, from
+// where the moves on their way lead, it's called every frame a key is held.
+func (s *gameSession) move(dir Direction) {
+	info := s.localPlayerInfo()
+	if !info.alive {
+		return
+	}
+	now := time.Now()
+	if now.Sub(s.moveTime) < s.settings.moveInterval(s.world.localPlayer().powerUps.speed()) {
+		return
+	}
+	if len(s.pending) >= maxPendingMoves {
+		return
+	}
+	// walk on from where the moves on their way lead
+	info.pos = s.predictedPos()
+	info.powerUps = s.world.localPlayer().powerUps
+	next := s.settings.getNextPosition(info.pos, dir)
+	if !s.world.canMove(info, next) {
+		return
+	}
+	info.pos = next
+	s.pending = append(s.pending, pendingMove{pos: next, sent: now})
+	s.moveTime = now
+	// handle user move
+	s.sendAsync(&UserMoveEvent{
+		playerInfo: info,
+	})
+}
+
+// handle set bomb on empty block, where the moves on their way lead. The
+// bomb follows the moves in the topic, so it's set where the player is drawn,
+// and a move rejected before it rejects the bomb too.
+func (s *gameSession) placeBomb() {
+	info := s.localPlayerInfo()
+	info.pos = s.predictedPos()
+	if !s.world.canSetBomb(info.name, info.pos) {
+		// the world would ignore it
+		return
+	}
+	s.sendAsync(&SetBombEvent{
+		bombName: info.name + "-" + randStringRunes(5),
+		pos:      info.pos,
+	})
+}
+
+func (s *gameSession) revive() {
+	info := s.localPlayerInfo()
+	if s.world.gameMap != nil {
+		info.pos = s.world.gameMap.pickSpawn(s.world)
+	}
+	s.sendAsync(&UserReviveEvent{
+		playerInfo: info,
+	})
+}
+
+// join the room, the clients which don't know map files take the
+// obstacles of gameMap as a random map
+func (s *gameSession) join(gameMap *gameMap) {
+	info := s.world.localPlayer()
+	newMapList := s.world.genRandomObstacleList(s.settings.newMapSeed())
+	if gameMap != nil {
+		newMapList = gameMap.Obstacles
+	}
+	s.sendAsync(&UserJoinEvent{
+		playerInfo: info,
+		Obstacles:  newMapList,
+	})
+}
+
+// predictedPos is where the local player is after the moves on their way
+func (s *gameSession) predictedPos() Position {
+	if n := len(s.pending); n > 0 {
+		return s.pending[n-1].pos
+	}
+	return s.world.localPlayer().pos
+}
+
+// reconcile drops the local move the world applied, or all the predicted
+// moves when the world disagrees with them, the local player goes back to
+// where the world has it
+func (s *gameSession) reconcile(event Event) {
+	if len(s.pending) == 0 {
+		return
+	}
+	me := s.world.localPlayer()
+	var name string
+	switch e := event.(type) {
+	case *UserMoveEvent:
+		if e.name == me.name && e.pos == s.pending[0].pos && me.pos == e.pos {
+			s.pending = s.pending[1:]
+			return
+		}
+		name = e.name
+	case *UserDeadEvent:
+		name = e.name
+	case *UserReviveEvent:
+		name = e.name
+	case *UserJoinEvent:
+		name = e.name
+	}
+	if name == me.name {
+		s.pending = nil
+	}
+}
+
+func (s *gameSession) sendAsync(event Event) {
+	// don't block
+	select {
+	case s.sendCh <- event:
+	default:
+		log.Warning("[sendAsync] there is event being abandoned")
+		s.client.stats.addDropped()
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"time"
+)
+
+// RoomConfigType and RoomMapType are the types of the messages in the
+// config topic, they're not Events, the settings or the map file are in
+// Payload as json
+const (
+	RoomConfigType = "RoomConfig"
+	RoomMapType    = "RoomMap"
+)
+
+const (
+	// defaultRoomName is the settings in config.yml of the rooms not listed
+	defaultRoomName = "default"
+	// a map is at most maxMapGrids grids wide and high, see avroPosStride
+	minMapGrids = 5
+	maxMapGrids = 1000
+)
+
+// roomSettings is what a room can change of the game. The first client or
+// server in a room publishes its settings from config.yml to the config
+// topic, everyone in the room plays by them until the room is gone.
+type roomSettings struct {
+	// the map is Width x Height grids, a grid is GridSize pixels
+	Width    int `yaml:"width" json:"width"`
+	Height   int `yaml:"height" json:"height"`
+	GridSize int `yaml:"gridSize" json:"gridSize"`
+	// the flame of a bomb reaches BombLength grids in every direction
+	BombLength int `yaml:"bombLength" json:"bombLength"`
+	// a bomb explodes ExplodeTime after it's set, the flame disappears FlameTime later
+	ExplodeTime time.Duration `yaml:"explodeTime" json:"explodeTime"`
+	FlameTime   time.Duration `yaml:"flameTime" json:"flameTime"`
+	// a player sets a bomb at most every BombCooldown
+	BombCooldown time.Duration `yaml:"bombCooldown" json:"bombCooldown"`
+	// holding a key, a player walks a grid every MoveInterval at speed 1
+	MoveInterval time.Duration `yaml:"moveInterval" json:"moveInterval"`
+	// the map is generated again every UpdateObstacleTime
+	UpdateObstacleTime time.Duration `yaml:"updateObstacleTime" json:"updateObstacleTime"`
+	// the part of the grids with obstacles of every type
+	IndestructibleDensity float64 `yaml:"indestructibleDensity" json:"indestructibleDensity"`
+	DestructibleDensity   float64 `yaml:"destructibleDensity" json:"destructibleDensity"`
+	// the random maps are symmetric by one of symmetryNames
+	Symmetry string `yaml:"symmetry" json:"symmetry"`
+	// the random maps are generated by MapSeed, 0 is a new seed for every map
+	MapSeed     int64              `yaml:"mapSeed" json:"mapSeed"`
+	RandomBombs randomBombSettings `yaml:"randomBombs" json:"randomBombs"`
+	PowerUps    powerUpSettings    `yaml:"powerUps" json:"powerUps"`
+}
+
+func defaultRoomSettings() *roomSettings {
+	return &roomSettings{
+		Width:                 30,
+		Height:                25,
+		GridSize:              20,
+		BombLength:            6,
+		ExplodeTime:           2 * time.Second,
+		FlameTime:             2 * time.Second,
+		BombCooldown:          300 * time.Millisecond,
+		MoveInterval:          150 * time.Millisecond,
+		UpdateObstacleTime:    time.Minute,
+		IndestructibleDensity: 0.2,
+		DestructibleDensity:   0.25,
+		Symmetry:              symmetryNone,
+		RandomBombs:           defaultRandomBombSettings,
+		PowerUps:              defaultPowerUpSettings,
+	}
+}
+
+func getRoomConfigTopicName(roomName string) string {
+	return roomName + "-config-topic"
+}
+
+// getRoomSettings overlays the default and the room in config.yml on the
+// built-in settings, a room only lists what it changes
+func getRoomSettings(roomName string) *roomSettings {
+	settings := defaultRoomSettings()
+	if pulsarConfig == nil {
+		return settings
+	}
+	for _, name := range []string{defaultRoomName, roomName} {
+		node, ok := pulsarConfig.Rooms[name]
+		if !ok {
+			continue
+		}
+		if err := node.Decode(settings); err != nil {
+			log.Errorf("[getRoomSettings] invalid settings of room %s: %v", name, err)
+		}
+	}
+	return settings
+}
+
+func (s *roomSettings) validate() error {
+	if s.Width < minMapGrids || s.Width > maxMapGrids || s.Height < minMapGrids || s.Height > maxMapGrids {
+		return fmt.Errorf("the map must be %d to %d grids wide and high", minMapGrids, maxMapGrids)
+	}
+	if s.GridSize <= 0 || s.BombLength <= 0 {
+		return errors.New("gridSize and bombLength must be positive")
+	}
+	if s.explodeTicks() <= 0 || s.flameTicks() <= 0 || s.UpdateObstacleTime <= 0 {
+		return errors.New("explodeTime, flameTime and updateObstacleTime must be positive")
+	}
+	if s.BombCooldown < 0 {
+		return errors.New("bombCooldown can't be negative")
+	}
+	if s.MoveInterval <= 0 {
+		return errors.New("moveInterval must be positive")
+	}
+	if s.IndestructibleDensity < 0 || s.DestructibleDensity < 0 || s.IndestructibleDensity+s.DestructibleDensity > 1 {
+		return errors.New("the obstacle densities must add up to at most 1")
+	}
+	if !stringsContain(symmetryNames, s.Symmetry) {
+		return fmt.Errorf("symmetry must be %s", strings.Join(symmetryNames, "/"))
+	}
+	return s.PowerUps.validate(s.BombLength)
+}
+
+// the screen of the room, the score bar is at the bottom
+func (s *roomSettings) screenSize() (int, int) {
+	return s.Width * s.GridSize, s.Height*s.GridSize + scoreBarHeight
+}
+
+func (s *roomSettings) totalGridCount() int {
+	return s.Width * s.Height
+}
+
+func (s *roomSettings) indestructibleObstacleCount() int {
+	return int(float64(s.totalGridCount()) * s.IndestructibleDensity)
+}
+
+func (s *roomSettings) destructibleObstacleCount() int {
+	return int(float64(s.totalGridCount()) * s.DestructibleDensity)
+}
+
+func (s *roomSettings) explodeTicks() int64 {
+	return int64(s.ExplodeTime) * ticksPerSecond / int64(time.Second)
+}
+
+func (s *roomSettings) flameTicks() int64 {
+	return int64(s.FlameTime) * ticksPerSecond / int64(time.Second)
+}
+
+func (s *roomSettings) bombCooldownTicks() int64 {
+	return int64(s.BombCooldown) * ticksPerSecond / int64(time.Second)
+}
+
+// decodeRoomSettings reads the settings in a message of the config topic
+func decodeRoomSettings(msg *EventMessage) (*roomSettings, error) {
+	settings := defaultRoomSettings()
+	if err := json.Unmarshal([]byte(msg.Payload), settings); err != nil {
+		return nil, err
+	}
+	return settings, settings.validate()
+}
+
+// decodeRoomMap reads the map file in a message of the config topic, it
+// must be valid and fit the settings of the room
+func decodeRoomMap(msg *EventMessage, settings *roomSettings) (*gameMap, error) {
+	if settings == nil {
+		return nil, errors.New("the room has no settings yet")
+	}
+	m := &gameMap{}
+	if err := json.Unmarshal([]byte(msg.Payload), m); err != nil {
+		return nil, err
+	}
+	if err := m.validate(); err != nil {
+		return nil, fmt.Errorf("invalid map %s: %w", m.Name, err)
+	}
+	return m, m.checkRoom(settings)
+}
+
+// readRoomSettings returns the first settings in the config topic of the
+// room, or nil if the room has none, and the latest map file published to
+// the room, or nil if its maps are random
+func readRoomSettings(transport Transport, roomName string) (*roomSettings, *gameMap, error) {
+	reader, err := transport.createReader(getRoomConfigTopicName(roomName), earliestPosition)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer reader.Close()
+	var settings *roomSettings
+	var roomMap *gameMap
+	for reader.hasNext() {
+		msg, err := reader.next(context.Background())
+		if err != nil {
+			return nil, nil, err
+		}
+		switch msg.event.Type {
+		case RoomConfigType:
+			if settings != nil {
+				// too late
+				break
+			}
+			if settings, err = decodeRoomSettings(msg.event); err != nil {
+				return nil, nil, err
+			}
+		case RoomMapType:
+			m, err := decodeRoomMap(msg.event, settings)
+			if err != nil {
+				log.Warning("[readRoomSettings] skip the map:", err)
+				break
+			}
+			roomMap = m
+		}
+	}
+	return settings, roomMap, nil
+}
+
+// publishRoomMap keeps the map file of the room in the config topic, for
+// the clients joining before a snapshot has it
+func publishRoomMap(transport Transport, roomName string, m *gameMap) error {
+	_, err := transport.publish(getRoomConfigTopicName(roomName), "", &EventMessage{
+		Type:    RoomMapType,
+		Name:    m.Name,
+		Payload: encodePayload(m),
+	})
+	return err
+}
+
+// joinRoomSettings returns the settings and the map file of the room, see
+// readRoomSettings, a new room takes the settings in config.yml. When
+// several clients create the room at once, the first settings in the topic win.
+func joinRoomSettings(transport Transport, roomName string) (*roomSettings, *gameMap, error) {
+	settings, roomMap, err := readRoomSettings(transport, roomName)
+	if err != nil || settings != nil {
+		return settings, roomMap, err
+	}
+	settings = getRoomSettings(roomName)
+	if loadedMap != nil {
+		// the room is as large as its map file
+		settings.Width, settings.Height = loadedMap.Width, loadedMap.Height
+	}
+	if err = settings.validate(); err != nil {
+		return nil, nil, fmt.Errorf("invalid settings of room %s in config.yml: %w", roomName, err)
+	}
+	_, err = transport.publish(getRoomConfigTopicName(roomName), "", &EventMessage{
+		Type:    RoomConfigType,
+		Name:    roomName,
+		Payload: encodePayload(settings),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	log.Info("[joinRoomSettings] create the room: ", roomName)
+	return readRoomSettings(transport, roomName)
+}
+
+// watchRoomSettings returns the settings of a room to watch or check, the
+// rooms created before the config topic are played by the built-in settings
+func watchRoomSettings(transport Transport, roomName string) *roomSettings {
+	settings, _, err := readRoomSettings(transport, roomName)
+	if err != nil {
+		log.Warning("[watchRoomSettings] read settings failed:", err)
+	}
+	if settings == nil {
+		return defaultRoomSettings()
+	}
+	return settings
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+)
+
+// WorldSnapshotType is the type of the messages in the snapshot topic, it's
+// not an Event, the snapshot is in Comment as json
+const WorldSnapshotType = "WorldSnapshot"
+
+// worldSnapshot is the full state of a room after a message of its topic.
+// New clients and replays start from the latest snapshot and apply the
+// messages after it, instead of starting from an empty world.
+type worldSnapshot struct {
+	Tick int64 `json:"tick"`
+	// the topic the world follows, the state topic of a room server or the
+	// event topic of a room without server
+	Topic string `json:"topic"`
+	// serialized id of the last message applied to the world
+	MessageID      []byte            `json:"messageId"`
+	Players        []snapshotPlayer  `json:"players"`
+	Bombs          []snapshotBomb    `json:"bombs"`
+	ExplodingBombs []snapshotBomb    `json:"explodingBombs"`
+	Obstacles      []int             `json:"obstacles"`
+	Map            *gameMap          `json:"map,omitempty"`
+	PowerUps       []snapshotPowerUp `json:"powerUps,omitempty"`
+	// the bombs set and gone lately of every owner, for the bomb rules
+	BombLives map[string][]bombLife `json:"bombLives,omitempty"`
+	Timers    []snapshotTimer       `json:"timers"`
+	TimerSeq  int64                 `json:"timerSeq"`
+	Scores    map[string]string     `json:"scores"`
+}
+
+type snapshotPlayer struct {
+	Name   string `json:"name"`
+	Avatar string `json:"avatar"`
+	X      int    `json:"x"`
+	Y      int    `json:"y"`
+	Alive  bool   `json:"alive"`
+	// empty in the snapshots before power-ups
+	PowerUps playerPowerUps `json:"powerUps"`
+}
+
+type snapshotBomb struct {
+	Name string `json:"name"`
+	X    int    `json:"x"`
+	Y    int    `json:"y"`
+	// 0 in the snapshots before power-ups, it's bombLength of the room
+	Length int `json:"length,omitempty"`
+	// the player who started the chain of an exploding bomb
+	ChainedBy string `json:"chainedBy,omitempty"`
+	// when an exploding bomb exploded and its place in the chain
+	ExplodeTick int64 `json:"explodeTick,omitempty"`
+	Depth       int   `json:"depth,omitempty"`
+}
+
+type snapshotPowerUp struct {
+	X    int         `json:"x"`
+	Y    int         `json:"y"`
+	Kind powerUpKind `json:"kind"`
+}
+
+type snapshotTimer struct {
+	Tick     int64     `json:"tick"`
+	Seq      int64     `json:"seq"`
+	Kind     timerKind `json:"kind"`
+	BombName string    `json:"bombName"`
+	X        int       `json:"x"`
+	Y        int       `json:"y"`
+	Dir      Direction `json:"dir"`
+	Step     int       `json:"step"`
+}
+
+// snapshot copies the state of the world, the caller sets Topic, MessageID
+// and Scores
+func (w *World) snapshot() *worldSnapshot {
+	s := &worldSnapshot{
+		Tick:      w.tick,
+		Obstacles: w.settings.genListFromObstacleMap(w.obstacleMap),
+		Map:       w.gameMap,
+		TimerSeq:  w.timerSeq,
+	}
+	sort.Ints(s.Obstacles)
+	for _, p := range w.nameToPlayers {
+		s.Players = append(s.Players, snapshotPlayer{
+			Name:     p.name,
+			Avatar:   p.avatar,
+			X:        p.pos.X,
+			Y:        p.pos.Y,
+			Alive:    p.alive,
+			PowerUps: p.powerUps,
+		})
+	}
+	sort.Slice(s.Players, func(i, j int) bool {
+		return s.Players[i].Name < s.Players[j].Name
+	})
+	for _, b := range w.nameToBombs {
+		s.Bombs = append(s.Bombs, snapshotBomb{Name: b.bombName, X: b.pos.X, Y: b.pos.Y, Length: b.length})
+	}
+	sort.Slice(s.Bombs, func(i, j int) bool {
+		return s.Bombs[i].Name < s.Bombs[j].Name
+	})
+	for pos, b := range w.explodingBombs {
+		s.ExplodingBombs = append(s.ExplodingBombs, snapshotBomb{
+			Name:        b.bombName,
+			X:           pos.X,
+			Y:           pos.Y,
+			Length:      b.length,
+			ChainedBy:   b.chainedBy,
+			ExplodeTick: b.explodeTick,
+			Depth:       b.depth,
+		})
+	}
+	sort.Slice(s.ExplodingBombs, func(i, j int) bool {
+		return s.ExplodingBombs[i].Name < s.ExplodingBombs[j].Name
+	})
+	for pos, kind := range w.powerUps {
+		s.PowerUps = append(s.PowerUps, snapshotPowerUp{X: pos.X, Y: pos.Y, Kind: kind})
+	}
+	sort.Slice(s.PowerUps, func(i, j int) bool {
+		a, b := s.PowerUps[i], s.PowerUps[j]
+		return a.Y < b.Y || a.Y == b.Y && a.X < b.X
+	})
+	if len(w.bombLives) > 0 {
+		s.BombLives = map[string][]bombLife{}
+		for owner, lives := range w.bombLives {
+			s.BombLives[owner] = append([]bombLife(nil), lives...)
+		}
+	}
+	for _, t := range w.timers {
+		s.Timers = append(s.Timers, snapshotTimer{
+			Tick:     t.tick,
+			Seq:      t.seq,
+			Kind:     t.kind,
+			BombName: t.bombName,
+			X:        t.pos.X,
+			Y:        t.pos.Y,
+			Dir:      t.dir,
+			Step:     t.step,
+		})
+	}
+	return s
+}
+
+// restore replaces the state of the world with the snapshot, the role,
+// the local player name, the settings and hashTicks of the world are kept
+func (w *World) restore(s *worldSnapshot) {
+	restored := newWorld(w.localPlayerName, w.role, w.settings)
+	restored.tick = s.Tick
+	restored.now = s.Tick
+	restored.hashTicks = w.hashTicks
+	restored.messageID = s.MessageID
+	restored.timerSeq = s.TimerSeq
+	for _, p := range s.Players {
+		info := &playerInfo{
+			name:     p.Name,
+			avatar:   p.Avatar,
+			pos:      Position{X: p.X, Y: p.Y},
+			alive:    p.Alive,
+			powerUps: p.PowerUps,
+		}
+		restored.nameToPlayers[info.name] = info
+		restored.posToPlayers[info.pos] = info
+	}
+	for owner, lives := range s.BombLives {
+		restored.bombLives[owner] = append([]bombLife(nil), lives...)
+	}
+	if s.BombLives == nil {
+		// the snapshots before bombLives count the bombs on the ground
+		for _, b := range s.Bombs {
+			owner := strings.Split(b.Name, "-")[0]
+			restored.bombLives[owner] = append(restored.bombLives[owner], bombLife{Name: b.Name, Set: s.Tick})
+		}
+	}
+	for _, b := range s.Bombs {
+		restored.setBomb(b.Name, Position{X: b.X, Y: b.Y}, b.length(w.settings))
+	}
+	for _, b := range s.ExplodingBombs {
+		pos := Position{X: b.X, Y: b.Y}
+		restored.explodingBombs[pos] = &Bomb{
+			bombName:    b.Name,
+			playerName:  strings.Split(b.Name, "-")[0],
+			pos:         pos,
+			length:      b.length(w.settings),
+			chainedBy:   b.ChainedBy,
+			explodeTick: b.ExplodeTick,
+			depth:       b.Depth,
+		}
+	}
+	for _, p := range s.PowerUps {
+		restored.powerUps[Position{X: p.X, Y: p.Y}] = p.Kind
+	}
+	restored.obstacleMap = w.settings.genObstacleMapFromList(s.Obstacles, nil)
+	restored.gameMap = s.Map
+	restored.updateFlameMap()
+	for _, t := range s.Timers {
+		restored.timers = append(restored.timers, &worldTimer{
+			tick:     t.Tick,
+			seq:      t.Seq,
+			kind:     t.Kind,
+			bombName: t.BombName,
+			pos:      Position{X: t.X, Y: t.Y},
+			dir:      t.Dir,
+			step:     t.Step,
+		})
+	}
+	*w = *restored
+}
+
+func (b *snapshotBomb) length(settings *roomSettings) int {
+	if b.Length == 0 {
+		return settings.BombLength
+	}
+	return b.Length
+}
+
+// skip returns true if the message is already in the snapshot
+func (s *worldSnapshot) skip(msg *receivedMessage) bool {
+	return s != nil && bytes.Equal(s.MessageID, msg.id)
+}
+
+// publishSnapshot sends the snapshot to the snapshot topic of the room, the
+// topic is compacted by the topic the world follows
+func publishSnapshot(transport Transport, roomName string, s *worldSnapshot) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	_, err = transport.publish(roomName+"-snapshot-topic", s.Topic, &EventMessage{
+		Type:    WorldSnapshotType,
+		Name:    roomName,
+		Tick:    s.Tick,
+		Comment: string(data),
+	})
+	return err
+}
+
+// readLatestSnapshot returns the latest snapshot of the room, or nil if
+// the room has none or it follows another topic than topic
+func readLatestSnapshot(transport Transport, roomName, topic string) (*worldSnapshot, error) {
+	reader, err := transport.createReader(roomName+"-snapshot-topic", latestPosition)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	if !reader.hasNext() {
+		return nil, nil
+	}
+	msg, err := reader.next(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return decodeSnapshot(msg.event, topic)
+}
+
+// readSnapshotBefore returns the last snapshot of topic in the room
+// published before t, or nil if there is none in the two snapshot periods
+// before t
+func readSnapshotBefore(transport Transport, roomName, topic string, t time.Time) (*worldSnapshot, error) {
+	start := position{publishTime: t.Add(-2 * snapshotTime * time.Second)}
+	reader, err := transport.createReader(roomName+"-snapshot-topic", start)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	var last *worldSnapshot
+	for reader.hasNext() {
+		msg, err := reader.next(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		if msg.publishTime.After(t) {
+			break
+		}
+		s, err := decodeSnapshot(msg.event, topic)
+		if err != nil {
+			return nil, err
+		}
+		if s != nil {
+			last = s
+		}
+	}
+	return last, nil
+}
+
+// decodeSnapshot returns nil if the message isn't a snapshot of topic, the
+// message ids of another topic mean nothing to its readers
+func decodeSnapshot(msg *EventMessage, topic string) (*worldSnapshot, error) {
+	if msg == nil || msg.Type != WorldSnapshotType {
+		return nil, nil
+	}
+	s := &worldSnapshot{}
+	err := json.Unmarshal([]byte(msg.Comment), s)
+	if err != nil {
+		return nil, err
+	}
+	if s.Topic != topic {
+		return nil, nil
+	}
+	return s, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestReadSnapshotOfTopic(t *testing.T) {
+	type published struct {
+		topic string
+		tick  int64
+	}
+	tests := []struct {
+		name      string
+		published []published
+		topic     string
+		// read the last one before now instead of the latest
+		before bool
+		// the tick of the snapshot read, 0 for none
+		want int64
+	}{
+		{name: "none", topic: "room-event-topic"},
+		{
+			name:      "the latest of the topic",
+			published: []published{{"room-event-topic", 1}, {"room-event-topic", 2}},
+			topic:     "room-event-topic",
+			want:      2,
+		},
+		{
+			name:      "the latest of another topic",
+			published: []published{{"room-event-topic", 1}, {"room-state-topic", 2}},
+			topic:     "room-event-topic",
+		},
+		{
+			name:      "the latest of the server",
+			published: []published{{"room-event-topic", 1}, {"room-state-topic", 2}},
+			topic:     "room-state-topic",
+			want:      2,
+		},
+		{
+			name:      "without topic",
+			published: []published{{"", 1}},
+			topic:     "room-event-topic",
+		},
+		{
+			name:      "before now",
+			published: []published{{"room-event-topic", 1}, {"room-state-topic", 2}},
+			topic:     "room-event-topic",
+			before:    true,
+			want:      1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := newTestTransport(t, newMemoryBroker(), "")
+			for _, p := range tt.published {
+				err := publishSnapshot(transport, "room", &worldSnapshot{Tick: p.tick, Topic: p.topic})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			var s *worldSnapshot
+			var err error
+			if tt.before {
+				s, err = readSnapshotBefore(transport, "room", tt.topic, time.Now())
+			} else {
+				s, err = readLatestSnapshot(transport, "room", tt.topic)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got int64
+			if s != nil {
+				got = s.Tick
+			}
+			if got != tt.want {
+				t.Fatalf("read the snapshot of tick %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWorldRestoresSnapshot(t *testing.T) {
+	w := newWorld("", roleObserver, defaultRoomSettings())
+	for _, e := range []Event{
+		joinAt(1000, "ann", 5, 5),
+		joinAt(1000, "bob", 7, 5),
+		bombAt(1000, "ann-1", 5, 5),
+		moveTo(1010, "ann", 5, 6),
+		bombAt(1100, "bob-1", 7, 5),
+	} {
+		w.Apply(e)
+	}
+	// ann-1 is exploding and bob-1 is on the ground
+	w.Step(1130)
+
+	data, err := json.Marshal(w.snapshot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &worldSnapshot{}
+	if err = json.Unmarshal(data, s); err != nil {
+		t.Fatal(err)
+	}
+	restored := newWorld("", roleObserver, defaultRoomSettings())
+	restored.restore(s)
+	if restored.stateHash() != w.stateHash() {
+		t.Fatal("the restored world is different")
+	}
+	// the timers go on in the restored world
+	w.Step(1300)
+	restored.Step(1300)
+	if restored.stateHash() != w.stateHash() {
+		t.Fatal("the restored world is different after the timers")
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	stateHashTicks = stateHashTime * ticksPerSecond
+	// the checker keeps the reference hashes of the last stateCheckTicks
+	stateCheckTicks = 10 * stateHashTicks
+	// the messages before a divergence shown in the report
+	stateCheckWindow = 10
+)
+
+// stateHash hashes everything the events and timers change, the clock
+// and the scores are not in it
+func (w *World) stateHash() string {
+	s := w.snapshot()
+	s.Tick = 0
+	var grids []string
+	for pos, p := range w.posToPlayers {
+		grids = append(grids, fmt.Sprintf("%d,%d:%s", pos.X, pos.Y, p.name))
+	}
+	sort.Strings(grids)
+	data, err := json.Marshal(struct {
+		World *worldSnapshot `json:"world"`
+		Grids []string       `json:"grids"`
+	}{s, grids})
+	if err != nil {
+		log.Error("[stateHash]", err)
+		return ""
+	}
+	h := fnv.New64a()
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// stateChecker applies the messages of a room to a reference world, which
+// hashes itself at the same ticks as the players do. A player whose hash
+// is still different one hash later diverged, it's not an event in flight.
+type stateChecker struct {
+	world *World
+	// reference hashes by tick
+	hashes map[int64]*referenceHash
+	// messages applied since the last reference hash
+	window  []*checkedMessage
+	players map[string]*playerCheck
+	// the hashes compared and the divergences found
+	compared    int
+	divergences []string
+}
+
+type referenceHash struct {
+	hash      string
+	messageID []byte
+	// the messages applied since the hash before
+	window []*checkedMessage
+}
+
+type checkedMessage struct {
+	id        []byte
+	eventType string
+	name      string
+}
+
+func (m *checkedMessage) String() string {
+	return fmt.Sprintf("%s %s %s", hex.EncodeToString(m.id), m.eventType, m.name)
+}
+
+type playerCheck struct {
+	// the first tick of the current difference, 0 if the player agrees
+	since int64
+	// the last message the player applied before since
+	messageID []byte
+	reported  bool
+}
+
+func newStateChecker(settings *roomSettings, snapshot *worldSnapshot) *stateChecker {
+	c := &stateChecker{
+		world:   newWorld("", roleObserver, settings),
+		hashes:  map[int64]*referenceHash{},
+		players: map[string]*playerCheck{},
+	}
+	c.world.hashTicks = stateHashTicks
+	if snapshot != nil {
+		c.world.restore(snapshot)
+	}
+	return c
+}
+
+func (c *stateChecker) handle(msg *receivedMessage) {
+	event, err := receivedEvent(msg)
+	if err != nil {
+		skipEvent("stateChecker", msg.event, err)
+		return
+	}
+	if e, ok := event.(*StateHashEvent); ok {
+		if e.tick <= 0 || e.tick%stateHashTicks != 0 {
+			// not a tick the worlds hash at
+			c.world.messageID = msg.id
+			return
+		}
+		// the reference reaches the tick when the first player does
+		c.advance(e.tick)
+		c.check(e)
+		// the players count it in their message ids too
+		c.world.messageID = msg.id
+		return
+	}
+	// the reference handles it when the players reach its tick
+	c.world.Apply(event)
+	c.world.messageID = msg.id
+	c.window = append(c.window, &checkedMessage{
+		id:        msg.id,
+		eventType: msg.event.Type,
+		name:      msg.event.Name,
+	})
+}
+
+// advance moves the reference to tick and keeps the hashes on the way
+func (c *stateChecker) advance(tick int64) {
+	for _, event := range c.world.Step(tick) {
+		e, ok := event.(*StateHashEvent)
+		if !ok {
+			continue
+		}
+		c.hashes[e.tick] = &referenceHash{
+			hash:      e.hash,
+			messageID: e.messageID,
+			window:    c.window,
+		}
+		c.window = nil
+	}
+	for tick := range c.hashes {
+		if tick < c.world.tick-stateCheckTicks {
+			delete(c.hashes, tick)
+		}
+	}
+}
+
+// check compares the hash of a player with the reference at the same tick
+func (c *stateChecker) check(e *StateHashEvent) {
+	ref, ok := c.hashes[e.tick]
+	if !ok {
+		// before the reference started
+		return
+	}
+	c.compared++
+	p, ok := c.players[e.name]
+	if !ok {
+		p = &playerCheck{}
+		c.players[e.name] = p
+	}
+	if e.hash == ref.hash {
+		if p.since != 0 && !p.reported {
+			log.Debugf("[stateChecker] %s caught up at %s", e.name, formatTick(e.tick))
+		}
+		p.since, p.reported = 0, false
+		return
+	}
+	if p.since == 0 {
+		p.since = e.tick
+		p.messageID = e.messageID
+		return
+	}
+	if p.reported {
+		return
+	}
+	p.reported = true
+	first := c.hashes[p.since]
+	if first == nil {
+		first = ref
+	}
+	report := strings.Builder{}
+	report.WriteString(fmt.Sprintf("%s diverged at %s, it applied up to %s and the reference up to %s",
+		e.name, formatTick(p.since), hex.EncodeToString(p.messageID), hex.EncodeToString(first.messageID)))
+	window := first.window
+	if len(window) > stateCheckWindow {
+		window = window[len(window)-stateCheckWindow:]
+	}
+	if len(window) > 0 {
+		report.WriteString(", after the events:")
+		for _, m := range window {
+			report.WriteString("\n    " + m.String())
+		}
+	}
+	c.divergences = append(c.divergences, report.String())
+	log.Warning("[stateChecker] ", report.String())
+}
+
+func (c *stateChecker) report() string {
+	var names []string
+	for name := range c.players {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	report := strings.Builder{}
+	report.WriteString(fmt.Sprintf("compared %d hashes of %d players: %s\n", c.compared, len(names), strings.Join(names, ", ")))
+	for _, d := range c.divergences {
+		report.WriteString(d + "\n")
+	}
+	report.WriteString(fmt.Sprintf("%d divergences\n", len(c.divergences)))
+	return report.String()
+}
+
+// formatTick shows the room clock at tick
+func formatTick(tick int64) string {
+	return fmt.Sprintf("tick %d (%s)", tick, time.UnixMilli(tick*1000/ticksPerSecond).Format("15:04:05.000"))
+}
+
+// runStateCheck checks the state hashes of the room from the -at position.
+// It stops at the end of the recording, or follows the room until stopCh is
+// closed if it starts from the latest snapshot.
+func runStateCheck(roomName, at string, authoritative bool, stopCh chan struct{}) error {
+	transport, err := newTransport("")
+	if err != nil {
+		return err
+	}
+	defer transport.Close()
+	start, err := parseAt(at)
+	if err != nil {
+		return err
+	}
+	follow := !start.earliest && start.id == nil && start.publishTime.IsZero()
+	topicName := roomName + "-event-topic"
+	if authoritative {
+		topicName = roomName + "-state-topic"
+	}
+	snapshot, err := readReplaySnapshot(transport, roomName, topicName, start)
+	if err != nil {
+		log.Warning("[stateChecker] read snapshot failed:", err)
+	}
+	if snapshot != nil {
+		start = position{id: snapshot.MessageID}
+	}
+	reader, err := transport.createReader(topicName, start)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	c := newStateChecker(watchRoomSettings(transport, roomName), snapshot)
+	for ctx.Err() == nil && (follow || reader.hasNext()) {
+		msg, err := reader.next(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			return err
+		}
+		if snapshot.skip(msg) {
+			continue
+		}
+		c.handle(msg)
+	}
+	fmt.Print(c.report())
+	return nil
+}
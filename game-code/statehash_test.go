@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestWorldHashesLatestTick(t *testing.T) {
+	tests := []struct {
+		name string
+		to   int64
+		// the ticks of the hashes
+		want []int64
+	}{
+		{name: "before the next hash", to: 1199},
+		{name: "at the next hash", to: 1200, want: []int64{1200}},
+		{name: "over several hashes", to: 100000, want: []int64{99900}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := newWorld("ann", roleObserver, defaultRoomSettings())
+			w.hashTicks = 300
+			// a new world jumps to the room clock without hashing
+			if events := w.Step(1000); len(events) != 0 {
+				t.Fatalf("a new world emits %d events", len(events))
+			}
+			var got []int64
+			for _, e := range w.Step(tt.to) {
+				if _, ok := e.(*StateHashEvent); ok {
+					got = append(got, e.header().tick)
+				}
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("hashes at %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("hashes at %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
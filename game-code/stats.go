@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// clientStats counts the events of a client, it's updated by the client
+// goroutines and read by the load test
+type clientStats struct {
+	lock sync.Mutex
+	// events published to the room
+	sent int
+	// events abandoned by sendAsync or failed to publish
+	dropped int
+	// events received from the room
+	received int
+	// publish to receive latency of every received event
+	latencies []time.Duration
+}
+
+func (s *clientStats) addSent() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.sent++
+}
+
+func (s *clientStats) addDropped() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.dropped++
+}
+
+func (s *clientStats) addReceived(latency time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.received++
+	s.latencies = append(s.latencies, latency)
+}
+
+// take moves the counts of s to total and resets s
+func (s *clientStats) take(total *clientStats) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	total.sent += s.sent
+	total.dropped += s.dropped
+	total.received += s.received
+	total.latencies = append(total.latencies, s.latencies...)
+	s.sent, s.dropped, s.received, s.latencies = 0, 0, 0, nil
+}
+
+func (s *clientStats) String() string {
+	latencies := append([]time.Duration(nil), s.latencies...)
+	sort.Slice(latencies, func(i, j int) bool {
+		return latencies[i] < latencies[j]
+	})
+	percentile := func(p float64) time.Duration {
+		if len(latencies) == 0 {
+			return 0
+		}
+		return latencies[int(float64(len(latencies)-1)*p)]
+	}
+	var max time.Duration
+	if len(latencies) > 0 {
+		max = latencies[len(latencies)-1]
+	}
+	return fmt.Sprintf("sent %d, dropped %d, received %d, latency p50 %v p95 %v p99 %v max %v",
+		s.sent, s.dropped, s.received,
+		percentile(0.5).Round(time.Microsecond), percentile(0.95).Round(time.Microsecond),
+		percentile(0.99).Round(time.Microsecond), max.Round(time.Microsecond))
+}
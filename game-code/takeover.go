@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var errSessionReplaced = errors.New("this player logged in again, the session is replaced")
+
+const (
+	// a new session waits takeoverTimeout for the last session to leave
+	takeoverTimeout = 3 * time.Second
+	takeoverRetry   = 200 * time.Millisecond
+	// the last session still holds the producer name of the player, the
+	// takeover is published with the name and the suffix
+	takeoverProducerSuffix = "#takeover"
+	// a session taking over from a hanging one subscribes with the player
+	// name and the suffix, a player has at most these two subscriptions
+	takeoverSubscriptionSuffix = "-takeover"
+)
+
+// A session saves its token locally when it joins a room and removes it
+// when it leaves. If a session finds the token of the last session of the
+// player, the last one crashed or is still running on this machine, so the
+// new session takes over instead of failing with errPlayerLoggedIn.
+
+// sessionTokenPath is the file of the token of the player in the room
+func sessionTokenPath(roomName, playerName string) (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "pulsar-bomb-game", "sessions", roomName, playerName), nil
+}
+
+func newSessionToken() string {
+	data := make([]byte, 16)
+	if _, err := rand.Read(data); err != nil {
+		log.Error("[newSessionToken]", err)
+	}
+	return hex.EncodeToString(data)
+}
+
+// hashSessionToken is published instead of the token, so others can't
+// take over with what they read from the topic
+func hashSessionToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+func readSessionToken(roomName, playerName string) string {
+	path, err := sessionTokenPath(roomName, playerName)
+	if err != nil {
+		return ""
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+func saveSessionToken(roomName, playerName, token string) {
+	path, err := sessionTokenPath(roomName, playerName)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(path), 0700)
+	}
+	if err == nil {
+		err = os.WriteFile(path, []byte(token), 0600)
+	}
+	if err != nil {
+		log.Warning("[saveSessionToken] the player can't take over after a crash:", err)
+	}
+}
+
+// removeSessionToken removes the token if it's still of the session, a
+// session that has been taken over leaves the token of the new one
+func removeSessionToken(roomName, playerName, token string) {
+	if readSessionToken(roomName, playerName) != token {
+		return
+	}
+	if path, err := sessionTokenPath(roomName, playerName); err == nil {
+		os.Remove(path)
+	}
+}
+
+// takeover asks the last session of the player to leave and subscribes
+// after it. If the last session hangs and the broker still holds its
+// subscription, this session subscribes with the takeover subscription.
+func (c *pulsarClient) takeover() error {
+	lastToken := readSessionToken(c.roomName, c.playerName)
+	if lastToken == "" {
+		// the player is logged in on another machine
+		return errPlayerLoggedIn
+	}
+	transport, err := newTransport(c.playerName + takeoverProducerSuffix)
+	if err != nil {
+		return err
+	}
+	_, err = transport.publish(c.getEventTopicName(), "", convertEventToMsg(&SessionTakeoverEvent{
+		eventHeader: eventHeader{tick: roomTick(time.Now())},
+		name:        c.playerName,
+		tokenHash:   hashSessionToken(lastToken),
+	}))
+	transport.Close()
+	if err != nil {
+		return err
+	}
+	log.Info("[takeover] ask the last session to leave: ", c.playerName)
+
+	deadline := time.Now().Add(takeoverTimeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(takeoverRetry)
+		err = c.connect()
+		if err == nil {
+			return nil
+		}
+		if err != errPlayerLoggedIn {
+			// the connection is broken, try again
+			log.Warning("[takeover] connect failed:", err)
+		}
+	}
+	if err != errPlayerLoggedIn {
+		return err
+	}
+	log.Warning("[takeover] the last session doesn't leave, use the takeover subscription")
+	c.subscriptionName = c.playerName + takeoverSubscriptionSuffix
+	return c.connect()
+}
+
+// removeStaleSubscription removes the other subscription of the player,
+// which a crashed session left with the messages piling up. It stays while
+// a hanging session still consumes it.
+func (c *pulsarClient) removeStaleSubscription() {
+	name := c.playerName + takeoverSubscriptionSuffix
+	if c.subscriptionName != c.playerName {
+		name = c.playerName
+	}
+	transport := c.getTransport()
+	if transport == nil {
+		return
+	}
+	subscription, err := transport.subscribe(c.getReceiveTopicName(), name, true)
+	if err != nil {
+		return
+	}
+	defer subscription.Close()
+	if err = subscription.unsubscribe(); err != nil {
+		log.Warning("[removeStaleSubscription]", err)
+	}
+}
+
+// isReplacedBy returns true if msg is the takeover of this session
+func (c *pulsarClient) isReplacedBy(msg *EventMessage) bool {
+	if msg.Type != TakeoverEventType || msg.Name != c.playerName {
+		return false
+	}
+	event, err := convertMsgToEvent(msg)
+	if err != nil {
+		return false
+	}
+	return event.(*SessionTakeoverEvent).tokenHash == hashSessionToken(c.token)
+}
+
+// leave releases the subscription to the new session of the player
+func (c *pulsarClient) leave() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	select {
+	case <-c.closeCh:
+		// Close releases it
+		return
+	default:
+	}
+	c.replaced = true
+	c.subscription.Close()
+	c.transport.Close()
+	c.transport, c.subscription = nil, nil
+}
+
+// replacedByNewSession returns true if another session of the player took over
+func (c *pulsarClient) replacedByNewSession() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.replaced
+}
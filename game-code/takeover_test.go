@@ -0,0 +1,97 @@
+package main
+
+import (
+	"testing"
+)
+
+// newTestClient returns a client of the room on the in-memory broker, it
+// isn't connected yet
+func newTestClient(t *testing.T, roomName, playerName string) *pulsarClient {
+	t.Helper()
+	last := transportName
+	transportName = memoryTransportName
+	t.Cleanup(func() { transportName = last })
+	// the session tokens of the test
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	c := &pulsarClient{
+		playerName:       playerName,
+		roomName:         roomName,
+		subscriptionName: playerName,
+		token:            newSessionToken(),
+		stats:            &clientStats{},
+		closeCh:          make(chan struct{}),
+	}
+	t.Cleanup(c.Close)
+	return c
+}
+
+// hasSubscription returns true if the memory broker keeps the subscription
+func hasSubscription(b *memoryBroker, topic, subscriptionName string) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	_, ok := b.getTopic(topic).subscriptions[subscriptionName]
+	return ok
+}
+
+func TestRemoveStaleSubscription(t *testing.T) {
+	tests := []struct {
+		name string
+		// the subscription of the client, and the other one left by the last session
+		subscription, stale string
+		// the last session still consumes the stale one
+		hanging bool
+		want    bool
+	}{
+		{name: "crashed on the takeover subscription", subscription: "ann", stale: "ann-takeover"},
+		{name: "crashed on the player subscription", subscription: "ann-takeover", stale: "ann"},
+		{name: "hanging", subscription: "ann", stale: "ann-takeover", hanging: true, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			roomName := "takeover-test-" + randStringRunes(8)
+			c := newTestClient(t, roomName, "ann")
+			c.subscriptionName = tt.subscription
+			topic := c.getReceiveTopicName()
+
+			last := newTestTransport(t, defaultMemoryBroker, "")
+			s, err := last.subscribe(topic, tt.stale, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.hanging {
+				s.Close()
+			}
+			if err = c.connect(); err != nil {
+				t.Fatal(err)
+			}
+			c.removeStaleSubscription()
+			if got := hasSubscription(defaultMemoryBroker, topic, tt.stale); got != tt.want {
+				t.Fatalf("%s is kept %v, want %v", tt.stale, got, tt.want)
+			}
+			if !hasSubscription(defaultMemoryBroker, topic, tt.subscription) {
+				t.Fatalf("%s of the client is removed", tt.subscription)
+			}
+		})
+	}
+}
+
+func TestTakeoverFromHangingSession(t *testing.T) {
+	roomName := "takeover-test-" + randStringRunes(8)
+	c := newTestClient(t, roomName, "ann")
+	// the last session holds the subscription and never reads the takeover
+	hanging := newTestTransport(t, defaultMemoryBroker, "")
+	if _, err := hanging.subscribe(c.getReceiveTopicName(), "ann", true); err != nil {
+		t.Fatal(err)
+	}
+	saveSessionToken(roomName, "ann", newSessionToken())
+
+	if err := c.connect(); err != errPlayerLoggedIn {
+		t.Fatalf("connect returns %v, want %v", err, errPlayerLoggedIn)
+	}
+	if err := c.takeover(); err != nil {
+		t.Fatal(err)
+	}
+	if c.subscriptionName != "ann"+takeoverSubscriptionSuffix {
+		t.Fatalf("subscribed as %s, want the takeover subscription", c.subscriptionName)
+	}
+}
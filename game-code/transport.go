@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/apache/pulsar-client-go/pulsar"
+	"time"
+)
+
+const (
+	pulsarTransportName = "pulsar"
+	memoryTransportName = "memory"
+)
+
+// errExclusiveConsumerBusy is returned by subscribe when another consumer
+// holds the exclusive subscription
+var errExclusiveConsumerBusy = errors.New("exclusive consumer is already connected")
+
+// transportName chooses the Transport implementation, see newTransport
+var transportName = pulsarTransportName
+
+// Transport is how a game client talks with the others in its room.
+// pulsarTransport connects to a real Pulsar cluster, memoryTransport
+// keeps everything in process so a room can run without any broker.
+type Transport interface {
+	// publish sends the event to the end of topic and returns its id, a
+	// compacted topic keeps only the latest message of every key. The
+	// message carries the producer name of the transport.
+	publish(topic, key string, msg *EventMessage) ([]byte, error)
+	// subscribe receives events of topic, an exclusive subscription
+	// rejects a second consumer with the same subscription name by
+	// errExclusiveConsumerBusy
+	subscribe(topic, subscriptionName string, exclusive bool) (eventSubscription, error)
+	// createReader reads topic from the start position, without any subscription
+	createReader(topic string, start position) (eventReader, error)
+	// listenTable calls f with every key's latest value of topic, and then with every update
+	listenTable(topic string, f func(key, value string)) error
+	Close()
+}
+
+// eventSubscription delivers the events of a subscription, every event
+// is acknowledged once it has been delivered
+type eventSubscription interface {
+	receive() <-chan *receivedMessage
+	// broken is closed when the subscription can't receive any more, it
+	// has to be replaced by a new connection
+	broken() <-chan struct{}
+	// seek resets the subscription to the start position
+	seek(start position) error
+	unsubscribe() error
+	Close()
+}
+
+// eventReader reads a topic one event after another
+type eventReader interface {
+	hasNext() bool
+	next(ctx context.Context) (*receivedMessage, error)
+	Close()
+}
+
+// position points to a place in a topic, it's the message of id if id
+// is set, the first message published since publishTime if publishTime is
+// set, otherwise the earliest or the latest message
+type position struct {
+	// the first message of the topic, otherwise the latest one
+	earliest bool
+	// serialized message id
+	id          []byte
+	publishTime time.Time
+}
+
+var (
+	earliestPosition = position{earliest: true}
+	latestPosition   = position{earliest: false}
+)
+
+// receivedMessage is an event with its metadata in the topic
+type receivedMessage struct {
+	// serialized message id
+	id          []byte
+	publishTime time.Time
+	// the name of the producer that published it
+	producer string
+	event    *EventMessage
+}
+
+// checkMessageID returns an error if id isn't a serialized message id of
+// the transport
+func checkMessageID(id []byte) error {
+	if transportName == memoryTransportName {
+		return checkBrokerMessageID(id)
+	}
+	_, err := pulsar.DeserializeMessageID(id)
+	return err
+}
+
+// newTransport connects to the broker. The messages it publishes carry
+// producerName, and the broker lets only one connection publish with a name
+// to a topic, so the room server knows who sent an intent. An empty name
+// lets the broker name the producers.
+func newTransport(producerName string) (Transport, error) {
+	codec, err := newEventCodec()
+	if err != nil {
+		return nil, err
+	}
+	if transportName == memoryTransportName {
+		return newMemoryTransport(defaultMemoryBroker, codec, producerName), nil
+	}
+	return newPulsarTransport(codec, producerName)
+}
@@ -12,6 +12,8 @@ var (
 	flameColor                  = color.RGBA{R: 255, G: 215, B: 0, A: 0xaf}
 	destructibleObstacleColor   = color.Gray{Y: 90}
 	indestructibleObstacleColor = color.White
+	reconnectingColor           = color.RGBA{A: 0xa0}
+	powerUpColor                = color.RGBA{R: 0x30, G: 0x90, B: 0xff, A: 0xff}
 )
 
 type playerInfo struct {
@@ -20,6 +22,8 @@ type playerInfo struct {
 	avatar string
 	pos    Position
 	alive  bool
+	// the world keeps them, the events don't carry them
+	powerUps playerPowerUps
 }
 
 type Direction int
@@ -32,7 +36,7 @@ const (
 	dirUp
 )
 
-func getNextPosition(position Position, direction Direction) Position {
+func (s *roomSettings) getNextPosition(position Position, direction Direction) Position {
 	f := map[Direction]func(int, int) (int, int){
 		dirLeft: func(x int, y int) (int, int) {
 			return x - 1, y
@@ -52,14 +56,41 @@ func getNextPosition(position Position, direction Direction) Position {
 	}
 	x, y := f[direction](position.X, position.Y)
 	res := Position{X: x, Y: y}
-	if validCoordinate(res) {
+	if s.validCoordinate(res) {
 		return res
 	}
 	return position
 }
 
-func validCoordinate(pos Position) bool {
-	return pos.X >= 0 && pos.Y >= 0 && pos.X < xGridCountInScreen && pos.Y < yGridCountInScreen
+func (s *roomSettings) validCoordinate(pos Position) bool {
+	return pos.X >= 0 && pos.Y >= 0 && pos.X < s.Width && pos.Y < s.Height
+}
+
+// distance is the manhattan distance
+func distance(a, b Position) int {
+	dx, dy := a.X-b.X, a.Y-b.Y
+	if dx < 0 {
+		dx = -dx
+	}
+	if dy < 0 {
+		dy = -dy
+	}
+	return dx + dy
+}
+
+// directionOf returns the direction from a to its neighbour b
+func directionOf(a, b Position) Direction {
+	switch {
+	case b.X < a.X:
+		return dirLeft
+	case b.X > a.X:
+		return dirRight
+	case b.Y > a.Y:
+		return dirDown
+	case b.Y < a.Y:
+		return dirUp
+	}
+	return dirNone
 }
 
 type Position struct {
@@ -71,8 +102,22 @@ type Bomb struct {
 	// the player name
 	playerName, bombName string
 	pos                  Position
-	// when exploded, this chanel will receive a message, control bomb moving
-	explodeCh chan struct{}
+	// the flame reaches length grids in every direction
+	length int
+	// the player who set the first bomb of the chain which exploded this
+	// one, empty if it exploded by itself
+	chainedBy string
+	// the tick it exploded at, and how many bombs before it in its chain
+	explodeTick int64
+	depth       int
+}
+
+// killer is the player credited with the kills of the flame
+func (b *Bomb) killer() string {
+	if b.chainedBy != "" {
+		return b.chainedBy
+	}
+	return b.playerName
 }
 
 func randStringRunes(n int) string {
@@ -84,30 +129,16 @@ func randStringRunes(n int) string {
 	return string(b)
 }
 
-func encodeXY(x, y int) int {
-	return y*xGridCountInScreen + x
+// encodeXY is the code of a grid in the obstacle lists of the room
+func (s *roomSettings) encodeXY(x, y int) int {
+	return y*s.Width + x
 }
 
-func decodeXY(code int) (int, int) {
-	return code % xGridCountInScreen, code / xGridCountInScreen
+func (s *roomSettings) decodeXY(code int) (int, int) {
+	return code % s.Width, code / s.Width
 }
 
-// sample k number in [0, n)
-func sample(n, k int) []int {
-	pickedNums := make([]int, k)
-	for i := 0; i < k; i++ {
-		pickedNums[i] = i
-	}
-	for i := k; i < n; i++ {
-		r := rand.Intn(i + 1)
-		if r < k {
-			pickedNums[r] = i
-		}
-	}
-	return pickedNums
-}
-
-func sliceContains(slice []int, p int) bool {
+func stringsContain(slice []string, p string) bool {
 	for _, e := range slice {
 		if e == p {
 			return true
@@ -116,24 +147,11 @@ func sliceContains(slice []int, p int) bool {
 	return false
 }
 
-func sliceRemove(slice []int, p int) bool {
-	for i, e := range slice {
-		if e == p {
-			if i == len(slice)-1 {
-				slice = slice[:i]
-			} else {
-				slice = append(slice[:i], slice[i+1:]...)
-			}
-		}
-	}
-	return false
-}
-
-func getExplodeFlame(pos Position, f func(p Position) bool) []Position {
+func (s *roomSettings) getExplodeFlame(pos Position, length int, f func(p Position) bool) []Position {
 	var positions []Position
-	for i := pos.X - 1; i >= pos.X-bombLength; i-- {
+	for i := pos.X - 1; i >= pos.X-length; i-- {
 		p := Position{X: i, Y: pos.Y}
-		if !validCoordinate(p) {
+		if !s.validCoordinate(p) {
 			break
 		}
 		if f != nil && !f(p) {
@@ -141,9 +159,9 @@ func getExplodeFlame(pos Position, f func(p Position) bool) []Position {
 		}
 		positions = append(positions, p)
 	}
-	for i := pos.X; i <= pos.X+bombLength; i++ {
+	for i := pos.X; i <= pos.X+length; i++ {
 		p := Position{X: i, Y: pos.Y}
-		if !validCoordinate(p) {
+		if !s.validCoordinate(p) {
 			break
 		}
 		if f != nil && !f(p) {
@@ -151,9 +169,9 @@ func getExplodeFlame(pos Position, f func(p Position) bool) []Position {
 		}
 		positions = append(positions, p)
 	}
-	for j := pos.Y - 1; j >= pos.Y-bombLength; j-- {
+	for j := pos.Y - 1; j >= pos.Y-length; j-- {
 		p := Position{X: pos.X, Y: j}
-		if !validCoordinate(p) {
+		if !s.validCoordinate(p) {
 			break
 		}
 		if f != nil && !f(p) {
@@ -161,9 +179,9 @@ func getExplodeFlame(pos Position, f func(p Position) bool) []Position {
 		}
 		positions = append(positions, p)
 	}
-	for j := pos.Y; j <= pos.Y+bombLength; j++ {
+	for j := pos.Y; j <= pos.Y+length; j++ {
 		p := Position{X: pos.X, Y: j}
-		if !validCoordinate(p) {
+		if !s.validCoordinate(p) {
 			break
 		}
 		if f != nil && !f(p) {
@@ -2,137 +2,367 @@ package main
 
 import (
 	"context"
-	"encoding/json"
-	"github.com/apache/pulsar-client-go/pulsar"
+	"encoding/hex"
+	"fmt"
 	"github.com/hajimehoshi/ebiten/v2"
 	"github.com/hajimehoshi/ebiten/v2/ebitenutil"
 	"github.com/hajimehoshi/ebiten/v2/inpututil"
 	log "github.com/sirupsen/logrus"
 	"image/color"
 	"os"
+	"sort"
+	"strings"
 	"time"
 )
 
+const (
+	// idle gaps of the recording longer than this are skipped
+	maxReplayGap = 5 * ticksPerSecond
+	// GameReplay copies its world every replaySnapshotTicks to scrub backward
+	replaySnapshotTicks = 10 * ticksPerSecond
+	// arrow keys scrub replayScrubTicks backward or forward
+	replayScrubTicks = 10 * ticksPerSecond
+)
+
+var (
+	replaySpeeds        = []float64{0.5, 1, 2, 4}
+	replaySpeedKeys     = []ebiten.Key{ebiten.Key1, ebiten.Key2, ebiten.Key3, ebiten.Key4}
+	timelineColor       = color.Gray{Y: 60}
+	timelinePlayedColor = color.RGBA{R: 0x34, G: 0xa0, B: 0xff, A: 0xff}
+)
+
+// GameReplay plays the recorded events at the ticks they happened
 type GameReplay struct {
-	*BombGame
-	cancel context.CancelFunc
+	world *World
+	// the world before the first entry
+	base      *World
+	receiveCh chan *receivedMessage
+	transport Transport
+	cancel    context.CancelFunc
+
+	// recorded events in topic order
+	entries []*replayEntry
+	// index of the next entry to apply
+	cursor int
+	// the replay clock in ticks, it runs speed ticks every Update
+	clock  float64
+	speed  float64
+	paused bool
+	// copies of the world in order of clock
+	snapshots []*replaySnapshot
 }
 
-func NewGameReplay(roomName, at string) *GameReplay {
+type replayEntry struct {
+	// the tick when the event happened
+	tick int64
+	// serialized message id
+	id    []byte
+	event Event
+}
+
+// replaySnapshot is the world before applying entries[cursor]
+type replaySnapshot struct {
+	clock  float64
+	cursor int
+	world  *World
+}
+
+// authoritative replays the events accepted by the room server
+func NewGameReplay(roomName, at string, authoritative bool) (*GameReplay, error) {
+	transport, err := newTransport("")
+	if err != nil {
+		return nil, err
+	}
+	start, err := parseAt(at)
+	if err != nil {
+		transport.Close()
+		return nil, err
+	}
+	topicName := roomName + "-event-topic"
+	if authoritative {
+		topicName = roomName + "-state-topic"
+	}
+	// no local player, replay only follows the recorded events
+	world := newWorld("", roleObserver, watchRoomSettings(transport, roomName))
+	snapshot, err := readReplaySnapshot(transport, roomName, topicName, start)
+	if err != nil {
+		log.Warning("[Playback] read snapshot failed:", err)
+	}
+	if snapshot != nil {
+		world.restore(snapshot)
+		start = position{id: snapshot.MessageID}
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
-	game := &BombGame{
-		nameToPlayers:  map[string]*playerInfo{},
-		posToPlayers:   map[Position]*playerInfo{},
-		nameToBombs:    map[string]*Bomb{},
-		posToBombs:     map[Position]*Bomb{},
-		explodingBombs: map[Position]*Bomb{},
-		flameMap:       map[Position]*Bomb{},
-		receiveCh:      readAllMessage(ctx, roomName, at),
+	receiveCh, err := readAllMessage(ctx, transport, topicName, start, snapshot)
+	if err != nil {
+		cancel()
+		transport.Close()
+		return nil, err
 	}
+	ebiten.SetWindowSize(world.settings.screenSize())
 	return &GameReplay{
-		BombGame: game,
-		cancel:   cancel,
+		world:     world,
+		base:      world.clone(),
+		receiveCh: receiveCh,
+		transport: transport,
+		cancel:    cancel,
+		speed:     1,
+	}, nil
+}
+
+// readReplaySnapshot returns the snapshot of topic to start the replay
+// from, the replay of the earliest or a message id has none
+func readReplaySnapshot(transport Transport, roomName, topic string, start position) (*worldSnapshot, error) {
+	if !start.publishTime.IsZero() {
+		return readSnapshotBefore(transport, roomName, topic, start.publishTime)
+	}
+	if !start.earliest && start.id == nil {
+		return readLatestSnapshot(transport, roomName, topic)
 	}
+	return nil, nil
 }
 
 func (g *GameReplay) Close() {
-	close(g.BombGame.receiveCh)
 	g.cancel()
+	g.transport.Close()
 }
 
-func readAllMessage(ctx context.Context, roomName, at string) chan Event {
-	topicName := roomName + "-event-topic"
-	var start pulsar.MessageID
-	if at == "latest" {
-		start = pulsar.LatestMessageID()
-	} else {
-		start = pulsar.EarliestMessageID()
-	}
-	client, err := pulsar.NewClient(readClientOptionFromYaml())
-	reader, err := client.CreateReader(pulsar.ReaderOptions{
-		Topic:          topicName,
-		StartMessageID: start,
-		Schema:         pulsar.NewJSONSchema(eventJsonSchemaDef, nil),
-	})
+// readAllMessage reads the recorded messages after the snapshot as fast as
+// possible, GameReplay schedules them
+func readAllMessage(ctx context.Context, transport Transport, topicName string, start position, snapshot *worldSnapshot) (chan *receivedMessage, error) {
+	reader, err := transport.createReader(topicName, start)
 	if err != nil {
-		log.Error("[Playback]", err)
+		return nil, err
 	}
 
-	ch := make(chan Event)
+	ch := make(chan *receivedMessage, 1000)
 	go func() {
-		// play back the game, don't too fast
-		tick := time.Tick(200 * time.Millisecond)
-		for true {
-			msg, _ := reader.Next(ctx)
-			var actionMsg EventMessage
-			if msg != nil {
-				err = json.Unmarshal(msg.Payload(), &actionMsg)
-				if err != nil {
-					log.Error("[Playback][json.Unmarshal]", err)
-					continue
+		defer reader.Close()
+		for {
+			msg, err := reader.next(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Error("[Playback]", err)
 				}
+				return
+			}
+			if snapshot.skip(msg) {
+				continue
 			}
 			select {
+			case ch <- msg:
 			case <-ctx.Done():
-				reader.Close()
 				return
-			case <-tick:
-				ch <- convertMsgToEvent(&actionMsg)
 			}
 		}
 	}()
-	return ch
+	return ch, nil
+}
+
+// parseAt parses the -at flag, it's earliest, latest, a RFC3339 time like
+// 2022-11-25T20:00:00+08:00, a duration before now like -5m, or a message
+// id in hex which is shown when the replay is paused
+func parseAt(at string) (position, error) {
+	switch at {
+	case "", "earliest":
+		return earliestPosition, nil
+	case "latest":
+		return latestPosition, nil
+	}
+	if strings.HasPrefix(at, "-") {
+		if d, err := time.ParseDuration(at); err == nil {
+			return position{publishTime: time.Now().Add(d)}, nil
+		}
+	}
+	if t, err := time.Parse(time.RFC3339, at); err == nil {
+		return position{publishTime: t}, nil
+	}
+	if id, err := hex.DecodeString(at); err == nil && len(id) > 0 && checkMessageID(id) == nil {
+		return position{id: id}, nil
+	}
+	return position{}, fmt.Errorf("invalid -at %q, use earliest, latest, RFC3339 time, -5m or message id", at)
+}
+
+// eventTick is when the recorded event happened, the events sent before
+// they carried a tick use the publish time
+func eventTick(msg *receivedMessage, event Event) int64 {
+	if tick := event.header().tick; tick != 0 {
+		return tick
+	}
+	return roomTick(msg.publishTime)
+}
+
+// receive buffers the messages read so far
+func (g *GameReplay) receive() {
+	for {
+		select {
+		case msg := <-g.receiveCh:
+			event, err := receivedEvent(msg)
+			if err != nil {
+				skipEvent("Playback", msg.event, err)
+				continue
+			}
+			entry := &replayEntry{
+				tick:  eventTick(msg, event),
+				id:    msg.id,
+				event: event,
+			}
+			if len(g.entries) == 0 {
+				// start a moment before the first event
+				g.clock = float64(entry.tick - ticksPerSecond)
+			}
+			g.entries = append(g.entries, entry)
+		default:
+			return
+		}
+	}
 }
 
 func (g *GameReplay) Update() error {
-	// listen to event
-	select {
-	case event := <-g.receiveCh:
-		event.handle(g.BombGame)
-	default:
+	g.receive()
+
+	for i, key := range replaySpeedKeys {
+		if inpututil.IsKeyJustPressed(key) {
+			g.speed = replaySpeeds[i]
+		}
+	}
+	if inpututil.IsKeyJustPressed(ebiten.KeySpace) {
+		g.paused = !g.paused
+	}
+	if inpututil.IsKeyJustPressed(ebiten.KeyArrowLeft) {
+		g.seek(g.clock - replayScrubTicks)
+	} else if inpututil.IsKeyJustPressed(ebiten.KeyArrowRight) {
+		g.seek(g.clock + replayScrubTicks)
 	}
 	if inpututil.IsKeyJustPressed(ebiten.KeyEscape) {
 		g.Close()
 		return os.ErrClosed
 	}
+
+	if !g.paused && len(g.entries) > 0 {
+		g.clock += g.speed
+		if g.cursor < len(g.entries) {
+			if next := float64(g.entries[g.cursor].tick); next-g.clock > maxReplayGap {
+				// nothing happened for a while
+				g.clock = next - ticksPerSecond
+			}
+		}
+		// never run ahead of the room
+		if live := float64(roomTick(time.Now()) - inputDelayTicks); g.clock > live {
+			g.clock = live
+		}
+	}
+
+	g.play()
 	return nil
 }
 
-func (g *GameReplay) Draw(screen *ebiten.Image) {
+// play applies the entries until the replay clock
+func (g *GameReplay) play() {
+	for g.cursor < len(g.entries) && float64(g.entries[g.cursor].tick) <= g.clock {
+		g.takeSnapshot()
+		g.world.Apply(g.entries[g.cursor].event)
+		g.cursor++
+	}
+	g.world.Step(int64(g.clock))
+}
 
-	for pos, _ := range g.posToBombs {
-		ebitenutil.DrawCircle(screen, float64(pos.X*gridSize+gridSize/2), float64(pos.Y*gridSize+gridSize/2), gridSize/2, bombColor)
+// takeSnapshot copies the world every replaySnapshotTicks
+func (g *GameReplay) takeSnapshot() {
+	if n := len(g.snapshots); n > 0 && g.snapshots[n-1].cursor >= g.cursor {
+		return
 	}
+	if n := len(g.snapshots); n > 0 && g.clock-g.snapshots[n-1].clock < replaySnapshotTicks {
+		return
+	}
+	g.snapshots = append(g.snapshots, &replaySnapshot{
+		clock:  g.clock,
+		cursor: g.cursor,
+		world:  g.world.clone(),
+	})
+}
 
-	for pos, t := range g.obstacleMap {
-		if t == destructibleObstacleType {
-			ebitenutil.DrawRect(screen, float64(pos.X*gridSize), float64(pos.Y*gridSize), gridSize, gridSize, destructibleObstacleColor)
+// seek moves the replay clock, going backward restores the nearest
+// snapshot before clock and plays from there
+func (g *GameReplay) seek(clock float64) {
+	if len(g.entries) == 0 {
+		return
+	}
+	if first := float64(g.entries[0].tick - ticksPerSecond); clock < first {
+		clock = first
+	}
+	if last := float64(g.entries[len(g.entries)-1].tick); clock > last {
+		clock = last
+	}
+	if clock < g.clock {
+		i := sort.Search(len(g.snapshots), func(i int) bool {
+			return g.snapshots[i].clock > clock
+		})
+		if i == 0 {
+			// before the first snapshot, play from the very beginning
+			g.world = g.base.clone()
+			g.cursor = 0
 		} else {
-			ebitenutil.DrawRect(screen, float64(pos.X*gridSize), float64(pos.Y*gridSize), gridSize, gridSize, indestructibleObstacleColor)
+			snapshot := g.snapshots[i-1]
+			g.world = snapshot.world.clone()
+			g.cursor = snapshot.cursor
 		}
 	}
+	g.clock = clock
+	g.play()
+}
 
-	for _, player := range g.nameToPlayers {
-		var userColor color.RGBA
-		if player.alive {
-			userColor = playerColor
-		} else {
-			userColor = deadPlayerColor
+func (g *GameReplay) Draw(screen *ebiten.Image) {
+	drawWorld(screen, g.world, nil)
+	g.drawTimeline(screen)
+}
+
+// drawTimeline draws the progress of replay and the speed at the bottom
+func (g *GameReplay) drawTimeline(screen *ebiten.Image) {
+	screenWidth, screenHeight := g.world.settings.screenSize()
+	y := float64(screenHeight - scoreBarHeight + 2)
+	ebitenutil.DrawRect(screen, 0, y, float64(screenWidth), 4, timelineColor)
+
+	var played, total time.Duration
+	if len(g.entries) > 0 {
+		first := g.entries[0].tick - ticksPerSecond
+		last := g.entries[len(g.entries)-1].tick
+		played = ticksToDuration(int64(g.clock) - first)
+		total = ticksToDuration(last - first)
+		if total > 0 {
+			progress := float64(played) / float64(total)
+			if progress > 1 {
+				progress = 1
+			}
+			ebitenutil.DrawRect(screen, 0, y, float64(screenWidth)*progress, 4, timelinePlayedColor)
 		}
-		ebitenutil.DrawRect(screen, float64(player.pos.X*gridSize), float64(player.pos.Y*gridSize), gridSize, gridSize, userColor)
-	}
-
-	for pos, val := range g.flameMap {
-		// draw the flame
-		if val != nil {
-			ebitenutil.DrawLine(screen, float64(pos.X*gridSize), float64(pos.Y*gridSize), float64(pos.X*gridSize+gridSize), float64(pos.Y*gridSize+gridSize), flameColor)
-			ebitenutil.DrawLine(screen, float64(pos.X*gridSize), float64(pos.Y*gridSize+gridSize/2), float64(pos.X*gridSize+gridSize/2), float64(pos.Y*gridSize+gridSize), flameColor)
-			ebitenutil.DrawLine(screen, float64(pos.X*gridSize+gridSize/2), float64(pos.Y*gridSize), float64(pos.X*gridSize+gridSize), float64(pos.Y*gridSize+gridSize/2), flameColor)
-			ebitenutil.DrawLine(screen, float64(pos.X*gridSize), float64(pos.Y*gridSize), float64(pos.X*gridSize+gridSize), float64(pos.Y*gridSize+gridSize), flameColor)
-			ebitenutil.DrawLine(screen, float64(pos.X*gridSize), float64(pos.Y*gridSize+gridSize/2), float64(pos.X*gridSize+gridSize/2), float64(pos.Y*gridSize+gridSize), flameColor)
-			ebitenutil.DrawLine(screen, float64(pos.X*gridSize+gridSize/2), float64(pos.Y*gridSize), float64(pos.X*gridSize+gridSize), float64(pos.Y*gridSize+gridSize/2), flameColor)
+	}
+
+	state := fmt.Sprintf("%gx", g.speed)
+	if g.paused {
+		state = "paused"
+		if g.cursor > 0 {
+			// the id of the last applied message, for -at
+			ebitenutil.DebugPrint(screen, "message id: "+hex.EncodeToString(g.entries[g.cursor-1].id))
 		}
 	}
+	ebitenutil.DebugPrintAt(screen, fmt.Sprintf("watch %s / %s | %s | 1-4: speed, space: pause, arrows: -/+10s",
+		formatDuration(played), formatDuration(total), state), 0, screenHeight-scoreBarHeight+10)
+}
+
+func (g *GameReplay) Layout(outsideWidth, outsideHeight int) (int, int) {
+	return g.world.settings.screenSize()
+}
+
+func ticksToDuration(ticks int64) time.Duration {
+	if ticks < 0 {
+		ticks = 0
+	}
+	return time.Duration(ticks) * time.Second / ticksPerSecond
+}
 
-	ebitenutil.DebugPrintAt(screen, "You are in watch mode", 0, screenHeight-scoreBarHeight+10)
+func formatDuration(d time.Duration) string {
+	seconds := int(d / time.Second)
+	return fmt.Sprintf("%02d:%02d", seconds/60, seconds%60)
 }
@@ -0,0 +1,795 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// the logical clock of World runs ticksPerSecond ticks every second, it's
+	// the same as the TPS of ebiten
+	ticksPerSecond = 60
+	// live worlds run inputDelayTicks behind the room clock, so the events
+	// sent at the same time arrive before the world reaches their tick
+	inputDelayTicks = ticksPerSecond / 10
+	// a gone bomb is remembered bombLifeTicks, the tick of an event is at
+	// most 2*maxTickSkew before the ones earlier in the topic
+	bombLifeTicks = 2 * maxTickSkew
+	// a late event is applied in order if the world is behind its tick by
+	// at most rollbackTicks, its tick is at most maxTickSkew before its
+	// publish time and the rest is the delivery
+	rollbackTicks = 4 * maxTickSkew
+	// the world is copied every checkpointTicks for the late events
+	checkpointTicks = ticksPerSecond / 2
+)
+
+// roomTick is the tick of the room clock at t, all clients of a room share it
+func roomTick(t time.Time) int64 {
+	return t.UnixMilli() * ticksPerSecond / 1000
+}
+
+// worldRole decides which deaths and pickups a world judges
+type worldRole int
+
+const (
+	// the client judges the death of its player
+	roleClient worldRole = iota
+	// the room server judges every death
+	roleServer
+	// only follows the events of others, like replay or a client of room server
+	roleObserver
+)
+
+// World is the state of a room without any window, audio or network.
+// Events change it by Apply, and Step moves its logical clock forward.
+//
+// Bombs explode, flames disappear and pushed bombs move at scheduled ticks,
+// and the events are handled at their ticks in the order of the topic, the
+// timers first at the same tick, so the worlds applying the same events are
+// identical whenever each event arrives.
+type World struct {
+	// logical clock
+	tick int64
+	// the tick of the event or timer being handled, it's behind the clock
+	// for a late event. Timers and cooldowns count from it, so a late
+	// event has the same effects as the one in time.
+	now  int64
+	role worldRole
+	// the map and the rules of the room
+	settings *roomSettings
+
+	// the player of this client, empty for replay
+	localPlayerName string
+	nameToPlayers   map[string]*playerInfo
+	posToPlayers    map[Position]*playerInfo
+
+	nameToBombs map[string]*Bomb
+	posToBombs  map[Position]*Bomb
+	// the bombs of every owner on the ground and gone in the last
+	// bombLifeTicks, the capacity and the cooldown of a SetBombEvent are
+	// judged at its tick by them, whatever the local clock has fired
+	bombLives map[string][]bombLife
+
+	// the bombs that are exploding (flame on grids)
+	explodingBombs map[Position]*Bomb
+
+	// this map is calculated by explodingBombs when explode or unexplode
+	flameMap map[Position]*Bomb
+
+	// two types of obstacle
+	obstacleMap map[Position]ObstacleType
+	// the map file of the room, nil if the map is random
+	gameMap *gameMap
+	// the power-ups on the ground
+	powerUps map[Position]powerUpKind
+	// the tick when this world sent the PowerUpCollectEvent of a grid, it's
+	// not a state of the room
+	collecting map[Position]int64
+	// the tick when this world sent the UserDeadEvent of a player, the
+	// player stays dead here until the room decides on it
+	dying map[string]int64
+
+	// scheduled by the logical clock, fired in order of (tick, seq)
+	timers   []*worldTimer
+	timerSeq int64
+	// events produced by the world, they should be sent to the room
+	outbox []Event
+
+	// the events after the clock, handled when the clock reaches them
+	pending  []*worldInput
+	inputSeq int64
+	// the tick of the last event or timer handled
+	handled int64
+	// the events handled since the first checkpoint, a late event takes the
+	// world back to the last checkpoint before it and they're handled again
+	history     []*worldInput
+	checkpoints []*worldCheckpoint
+
+	// the world emits a StateHashEvent every hashTicks, 0 never
+	hashTicks int64
+	// serialized id of the last message applied, set by the caller of Apply
+	messageID []byte
+}
+
+type timerKind int
+
+const (
+	timerExplode timerKind = iota
+	timerUndoExplode
+	timerPushBomb
+)
+
+// worldTimer is plain data, so the world can be copied with its timers
+type worldTimer struct {
+	tick, seq int64
+	kind      timerKind
+	bombName  string
+	// the next position and direction of a pushed bomb
+	pos  Position
+	dir  Direction
+	step int
+}
+
+// worldInput is an applied event, the events of a tick are handled in the
+// order they're applied
+type worldInput struct {
+	tick, seq int64
+	event     Event
+}
+
+// worldCheckpoint is a copy of the world before it handled anything at tick
+type worldCheckpoint struct {
+	tick  int64
+	world *World
+}
+
+func newWorld(localPlayerName string, role worldRole, settings *roomSettings) *World {
+	return &World{
+		role:            role,
+		settings:        settings,
+		localPlayerName: localPlayerName,
+		nameToPlayers:   map[string]*playerInfo{},
+		posToPlayers:    map[Position]*playerInfo{},
+		nameToBombs:     map[string]*Bomb{},
+		posToBombs:      map[Position]*Bomb{},
+		bombLives:       map[string][]bombLife{},
+		explodingBombs:  map[Position]*Bomb{},
+		flameMap:        map[Position]*Bomb{},
+		obstacleMap:     map[Position]ObstacleType{},
+		powerUps:        map[Position]powerUpKind{},
+		collecting:      map[Position]int64{},
+		dying:           map[string]int64{},
+	}
+}
+
+// Apply changes the world with the event at its tick, the events of a
+// topic are applied in its order. The clock never follows an event, one
+// after the clock waits for Step to reach its tick, and one before the
+// events or timers handled already takes the world back to handle them
+// again after it.
+func (w *World) Apply(event Event) {
+	if event == nil {
+		return
+	}
+	switch event.(type) {
+	case *StateHashEvent, *SessionTakeoverEvent, *RoomHostedEvent, *RoomUnhostedEvent:
+		// they're about the players, not the world
+		return
+	}
+	tick := event.header().tick
+	if tick <= 0 {
+		// events recorded before they carried a tick happen now
+		tick = w.tick
+	}
+	w.inputSeq++
+	in := &worldInput{tick: tick, seq: w.inputSeq, event: event}
+	switch {
+	case tick > w.tick:
+		i := sort.Search(len(w.pending), func(i int) bool {
+			return w.pending[i].tick > tick
+		})
+		w.pending = append(w.pending, nil)
+		copy(w.pending[i+1:], w.pending[i:])
+		w.pending[i] = in
+	case tick < w.handled:
+		w.rollback(in)
+	default:
+		w.handle(in)
+	}
+}
+
+// Step moves the logical clock to tick, fires the due timers, judges
+// deaths and pickups, and returns the events the world produced since the
+// last Step
+func (w *World) Step(tick int64) []Event {
+	w.advanceTo(tick)
+	w.checkDeaths()
+	w.checkPowerUps()
+
+	out := w.outbox
+	w.outbox = nil
+	return out
+}
+
+// advanceTo fires the timers until tick in order, the clock never goes back.
+// The state is hashed at the last multiple of hashTicks the clock passes,
+// a clock jumping over several of them hashes only the latest.
+func (w *World) advanceTo(tick int64) {
+	// a new world jumps to the room clock at once
+	if w.hashTicks > 0 && w.tick > 0 && tick > w.tick {
+		last := tick / w.hashTicks * w.hashTicks
+		if last > w.tick {
+			w.fireUntil(last)
+			w.emit(&StateHashEvent{
+				name:      w.localPlayerName,
+				hash:      w.stateHash(),
+				messageID: w.messageID,
+			})
+		}
+	}
+	w.fireUntil(tick)
+}
+
+// fireUntil fires the timers and handles the pending events until tick in
+// order, the timers first at the same tick
+func (w *World) fireUntil(tick int64) {
+	for {
+		var t *worldTimer
+		if len(w.timers) > 0 && w.timers[0].tick <= tick {
+			t = w.timers[0]
+		}
+		var in *worldInput
+		if len(w.pending) > 0 && w.pending[0].tick <= tick {
+			in = w.pending[0]
+		}
+		if t == nil && in == nil {
+			break
+		}
+		if in != nil && (t == nil || in.tick < t.tick) {
+			w.pending = w.pending[1:]
+			if in.tick > w.tick {
+				w.tick = in.tick
+			}
+			w.handle(in)
+			continue
+		}
+		w.checkpoint(t.tick)
+		w.timers = w.timers[1:]
+		if t.tick > w.tick {
+			w.tick = t.tick
+		}
+		w.now = t.tick
+		w.fire(t)
+		w.handled = t.tick
+	}
+	if tick > w.tick {
+		w.tick = tick
+	}
+	w.now = w.tick
+}
+
+// handle handles the event at its tick, it's not before the last event or
+// timer handled
+func (w *World) handle(in *worldInput) {
+	w.checkpoint(in.tick)
+	w.now = in.tick
+	in.event.handle(w)
+	w.now = w.tick
+	w.handled = in.tick
+	w.history = append(w.history, in)
+}
+
+// checkpoint copies the world before it handles anything at tick, every
+// checkpointTicks, and forgets the ones rollbackTicks ago
+func (w *World) checkpoint(tick int64) {
+	if n := len(w.checkpoints); n > 0 && tick < w.checkpoints[n-1].tick+checkpointTicks {
+		return
+	}
+	c := w.clone()
+	c.pending, c.history, c.checkpoints = nil, nil, nil
+	w.checkpoints = append(w.checkpoints, &worldCheckpoint{tick: tick, world: c})
+	for len(w.checkpoints) > 1 && w.checkpoints[1].tick <= tick-rollbackTicks {
+		w.checkpoints = w.checkpoints[1:]
+	}
+	first := w.checkpoints[0].tick
+	for len(w.history) > 0 && w.history[0].tick < first {
+		w.history = w.history[1:]
+	}
+}
+
+// rollback takes the world back to the last checkpoint before the late
+// event, and handles the events since then with it in order until the
+// clock. An event before every checkpoint happens at the first one.
+func (w *World) rollback(in *worldInput) {
+	i := sort.Search(len(w.checkpoints), func(i int) bool {
+		return w.checkpoints[i].tick > in.tick
+	}) - 1
+	if i < 0 {
+		i = 0
+		in.tick = w.checkpoints[0].tick
+	}
+	c := w.checkpoints[i]
+
+	var history, pending []*worldInput
+	for _, h := range w.history {
+		if h.tick < c.tick {
+			history = append(history, h)
+		} else {
+			pending = append(pending, h)
+		}
+	}
+	pending = append(pending, w.pending...)
+	pending = append(pending, in)
+	sort.Slice(pending, func(i, j int) bool {
+		a, b := pending[i], pending[j]
+		return a.tick < b.tick || a.tick == b.tick && a.seq < b.seq
+	})
+
+	tick := w.tick
+	restored := c.world.clone()
+	restored.messageID = w.messageID
+	restored.outbox = w.outbox
+	restored.collecting = w.collecting
+	restored.dying = w.dying
+	restored.inputSeq = w.inputSeq
+	restored.history = history
+	restored.checkpoints = w.checkpoints[:i+1]
+	restored.pending = pending
+	*w = *restored
+	w.fireUntil(tick)
+	// the deaths this world sent are on their way
+	for name := range w.dying {
+		if player, ok := w.nameToPlayers[name]; ok {
+			player.alive = false
+		}
+	}
+}
+
+// settle forgets the death this world sent when the room decides on the
+// player at or after it
+func (w *World) settle(name string) {
+	if tick, ok := w.dying[name]; ok && w.now >= tick {
+		delete(w.dying, name)
+	}
+}
+
+// after fires the timer delay ticks after the event or timer being handled
+func (w *World) after(delay int64, t *worldTimer) {
+	w.timerSeq++
+	t.tick = w.now + delay
+	t.seq = w.timerSeq
+	i := sort.Search(len(w.timers), func(i int) bool {
+		return w.timers[i].tick > t.tick
+	})
+	w.timers = append(w.timers, nil)
+	copy(w.timers[i+1:], w.timers[i:])
+	w.timers[i] = t
+}
+
+func (w *World) fire(t *worldTimer) {
+	switch t.kind {
+	case timerExplode:
+		w.explode(t.bombName)
+	case timerUndoExplode:
+		w.undoExplode(t.bombName)
+	case timerPushBomb:
+		w.pushBombStep(t)
+	}
+}
+
+// emit queues an event to be sent to the room, it happens at the current tick
+func (w *World) emit(event Event) {
+	event.header().tick = w.tick
+	w.outbox = append(w.outbox, event)
+}
+
+// removePlayerPos removes the grid of the player before it moves
+func (w *World) removePlayerPos(player *playerInfo) {
+	if p, ok := w.posToPlayers[player.pos]; ok && p.name == player.name {
+		delete(w.posToPlayers, player.pos)
+	}
+}
+
+// setObstacles replaces the obstacles, the obstacles of a map file don't
+// wall in the players, a random map is generated around them
+func (w *World) setObstacles(list []int) {
+	var free func(p Position) bool
+	if w.gameMap != nil {
+		free = func(p Position) bool {
+			_, ok := w.posToPlayers[p]
+			return !ok
+		}
+	}
+	w.obstacleMap = w.settings.genObstacleMapFromList(list, free)
+	w.removeCoveredPowerUps()
+}
+
+// removeCoveredPowerUps removes the power-ups under the obstacles
+func (w *World) removeCoveredPowerUps() {
+	for pos := range w.powerUps {
+		if _, ok := w.obstacleMap[pos]; ok {
+			delete(w.powerUps, pos)
+		}
+	}
+}
+
+func (w *World) localPlayer() *playerInfo {
+	return w.nameToPlayers[w.localPlayerName]
+}
+
+// judgedPlayers returns the players this world judges, a client judges
+// the local player and the server judges all
+func (w *World) judgedPlayers() []*playerInfo {
+	switch w.role {
+	case roleClient:
+		if player := w.localPlayer(); player != nil {
+			return []*playerInfo{player}
+		}
+	case roleServer:
+		names := make([]string, 0, len(w.nameToPlayers))
+		for name := range w.nameToPlayers {
+			names = append(names, name)
+		}
+		// keep the order of the judged events deterministic
+		sort.Strings(names)
+		players := make([]*playerInfo, 0, len(names))
+		for _, name := range names {
+			players = append(players, w.nameToPlayers[name])
+		}
+		return players
+	}
+	return nil
+}
+
+// checkDeaths judges the players in flame
+func (w *World) checkDeaths() {
+	for _, player := range w.judgedPlayers() {
+		w.checkDeath(player)
+	}
+}
+
+// player dead due to boom
+func (w *World) checkDeath(player *playerInfo) {
+	if player == nil || !player.alive {
+		return
+	}
+	if val, ok := w.flameMap[player.pos]; ok && val != nil {
+		player.alive = false
+		w.dying[player.name] = w.tick
+		w.emit(&UserDeadEvent{
+			playerInfo: &playerInfo{
+				name:   player.name,
+				pos:    player.pos,
+				avatar: player.avatar,
+				alive:  false,
+			},
+			// the player who set the bomb, or started the chain
+			killer: val.killer(),
+		})
+	}
+}
+
+// setBomb puts a bomb on the grid, its flame reaches length grids
+func (w *World) setBomb(bombName string, position Position, length int) *Bomb {
+	bomb := &Bomb{
+		bombName:   bombName,
+		playerName: strings.Split(bombName, "-")[0],
+		pos:        position,
+		length:     length,
+	}
+	w.nameToBombs[bomb.bombName] = bomb
+	w.posToBombs[bomb.pos] = bomb
+	return bomb
+}
+
+// bombLife is when a bomb is set and gone, Gone is 0 while it's on the ground
+type bombLife struct {
+	Name string `json:"name"`
+	Set  int64  `json:"set"`
+	Gone int64  `json:"gone,omitempty"`
+}
+
+// canSetBomb returns true if the rules of the room let the owner set a
+// bomb on the grid at the tick being handled. Every world checks SetBombEvent by it, so a client
+// sending more bombs than its player has doesn't change the room.
+func (w *World) canSetBomb(owner string, pos Position) bool {
+	if _, ok := w.obstacleMap[pos]; ok || !w.settings.validCoordinate(pos) {
+		return false
+	}
+	if _, ok := w.posToBombs[pos]; ok {
+		// one bomb a grid
+		return false
+	}
+	if owner == randomBombOwner {
+		max := w.settings.RandomBombs.Max
+		return max <= 0 || w.countBombs(randomBombOwner) < max
+	}
+	player, ok := w.nameToPlayers[owner]
+	if !ok || !player.alive {
+		return false
+	}
+	if w.countBombs(owner) >= player.powerUps.bombs(w.settings) {
+		return false
+	}
+	lives := w.bombLives[owner]
+	return len(lives) == 0 || w.now-lives[len(lives)-1].Set >= w.settings.bombCooldownTicks()
+}
+
+// addBombLife records the bomb set at the tick being handled, and forgets
+// the bombs gone bombLifeTicks before
+func (w *World) addBombLife(owner, bombName string) {
+	var lives []bombLife
+	for _, l := range w.bombLives[owner] {
+		if l.Gone == 0 || l.Gone >= w.now-bombLifeTicks {
+			lives = append(lives, l)
+		}
+	}
+	w.bombLives[owner] = append(lives, bombLife{Name: bombName, Set: w.now})
+}
+
+// endBombLife records the bomb gone at the tick being handled
+func (w *World) endBombLife(bomb *Bomb) {
+	lives := w.bombLives[bomb.playerName]
+	for i := range lives {
+		if lives[i].Name == bomb.bombName && lives[i].Gone == 0 {
+			lives[i].Gone = w.now
+		}
+	}
+}
+
+// bombLength is the flame of the next bomb of the player, random bombs
+// and the players gone have the shortest flame
+func (w *World) bombLength(playerName string) int {
+	if player, ok := w.nameToPlayers[playerName]; ok {
+		return player.powerUps.flame(w.settings)
+	}
+	return w.settings.BombLength
+}
+
+// countBombs returns the bombs of the player on the ground at the tick
+// being handled, a bomb the local clock has exploded after it still counts
+func (w *World) countBombs(playerName string) int {
+	count := 0
+	for _, l := range w.bombLives[playerName] {
+		if l.Gone == 0 || l.Gone > w.now {
+			count++
+		}
+	}
+	return count
+}
+
+func (w *World) removeBomb(bombName string) {
+	if bomb, ok := w.nameToBombs[bombName]; ok {
+		w.endBombLife(bomb)
+		delete(w.nameToBombs, bombName)
+		if _, ok = w.posToBombs[bomb.pos]; ok {
+			delete(w.posToBombs, bomb.pos)
+		}
+	}
+}
+
+// pushBomb moves the bomb linearly, step by step, until it explodes or
+// meets the border or an obstacle
+func (w *World) pushBomb(bomb *Bomb, direction Direction) {
+	w.after(ticksPerSecond/2, &worldTimer{
+		kind:     timerPushBomb,
+		bombName: bomb.bombName,
+		pos:      w.settings.getNextPosition(bomb.pos, direction),
+		dir:      direction,
+	})
+}
+
+func (w *World) pushBombStep(t *worldTimer) {
+	if t.step >= 8 {
+		return
+	}
+	bomb, ok := w.nameToBombs[t.bombName]
+	if !ok {
+		// bomb exploded, stop
+		return
+	}
+	if _, ok := w.obstacleMap[t.pos]; !w.settings.validCoordinate(t.pos) || ok {
+		// move to border or obstacle, stop
+		return
+	}
+	w.moveBomb(bomb, t.pos)
+	w.after(ticksPerSecond/2, &worldTimer{
+		kind:     timerPushBomb,
+		bombName: t.bombName,
+		pos:      w.settings.getNextPosition(t.pos, t.dir),
+		dir:      t.dir,
+		step:     t.step + 1,
+	})
+}
+
+func (w *World) moveBomb(bomb *Bomb, pos Position) {
+	if _, ok := w.posToBombs[bomb.pos]; !ok {
+		return
+	}
+	delete(w.posToBombs, bomb.pos)
+	bomb.pos = pos
+	w.posToBombs[pos] = bomb
+}
+
+// explode the bomb and the bombs in its flame, the flames disappear after
+// FlameTime. The chained bombs explode at once, in the order the flames
+// reach them, so every world resolves a chain the same way.
+func (w *World) explode(bombName string) {
+	bomb, ok := w.nameToBombs[bombName]
+	if !ok {
+		// bombs are set to the same place will cause this situation
+		return
+	}
+	if _, ok = w.posToBombs[bomb.pos]; !ok {
+		return
+	}
+	// remove the bomb in the grid, if this bomb is moving, it will stop moving
+	w.removeBomb(bomb.bombName)
+	chain := []*Bomb{bomb}
+	for len(chain) > 0 {
+		chain = append(chain[1:], w.detonate(chain[0])...)
+	}
+
+	// update flame map
+	w.updateFlameMap()
+}
+
+// detonate lights the flame of the removed bomb, it returns the bombs in
+// the flame, removed from their grids
+func (w *World) detonate(bomb *Bomb) []*Bomb {
+	// just mark the exploding bomb position, Draw() will generate the flame
+	w.explodingBombs[bomb.pos] = bomb
+	bomb.explodeTick = w.now
+
+	// explode may destroy obstacles, update obstacleMap
+	var chained []*Bomb
+	w.settings.getExplodeFlame(bomb.pos, bomb.length, func(p Position) bool {
+		if t, ok := w.obstacleMap[p]; ok {
+			if t == indestructibleObstacleType {
+				return false
+			} else if t == destructibleObstacleType {
+				delete(w.obstacleMap, p)
+				w.dropPowerUp(bomb.bombName, p)
+			}
+		}
+		if other, ok := w.posToBombs[p]; ok {
+			other.chainedBy = bomb.killer()
+			other.depth = bomb.depth + 1
+			w.removeBomb(other.bombName)
+			chained = append(chained, other)
+		}
+		return true
+	})
+
+	w.after(w.settings.flameTicks(), &worldTimer{
+		kind:     timerUndoExplode,
+		bombName: bomb.bombName,
+	})
+	return chained
+}
+
+// undoExplode puts out the flame of the bomb
+func (w *World) undoExplode(bombName string) {
+	for pos, bomb := range w.explodingBombs {
+		if bomb.bombName == bombName {
+			delete(w.explodingBombs, pos)
+			w.updateFlameMap()
+			return
+		}
+	}
+}
+
+// clone copies the world, the copy shares nothing with w
+func (w *World) clone() *World {
+	c := *w
+	players := map[*playerInfo]*playerInfo{}
+	clonePlayer := func(p *playerInfo) *playerInfo {
+		if _, ok := players[p]; !ok {
+			cp := *p
+			players[p] = &cp
+		}
+		return players[p]
+	}
+	bombs := map[*Bomb]*Bomb{}
+	cloneBomb := func(b *Bomb) *Bomb {
+		if b == nil {
+			return nil
+		}
+		if _, ok := bombs[b]; !ok {
+			cb := *b
+			bombs[b] = &cb
+		}
+		return bombs[b]
+	}
+
+	c.nameToPlayers = map[string]*playerInfo{}
+	for k, v := range w.nameToPlayers {
+		c.nameToPlayers[k] = clonePlayer(v)
+	}
+	c.posToPlayers = map[Position]*playerInfo{}
+	for k, v := range w.posToPlayers {
+		c.posToPlayers[k] = clonePlayer(v)
+	}
+	c.nameToBombs = map[string]*Bomb{}
+	for k, v := range w.nameToBombs {
+		c.nameToBombs[k] = cloneBomb(v)
+	}
+	c.posToBombs = map[Position]*Bomb{}
+	for k, v := range w.posToBombs {
+		c.posToBombs[k] = cloneBomb(v)
+	}
+	c.bombLives = map[string][]bombLife{}
+	for k, v := range w.bombLives {
+		c.bombLives[k] = append([]bombLife(nil), v...)
+	}
+	c.explodingBombs = map[Position]*Bomb{}
+	for k, v := range w.explodingBombs {
+		c.explodingBombs[k] = cloneBomb(v)
+	}
+	c.flameMap = map[Position]*Bomb{}
+	for k, v := range w.flameMap {
+		c.flameMap[k] = cloneBomb(v)
+	}
+	c.obstacleMap = map[Position]ObstacleType{}
+	for k, v := range w.obstacleMap {
+		c.obstacleMap[k] = v
+	}
+	c.powerUps = map[Position]powerUpKind{}
+	for k, v := range w.powerUps {
+		c.powerUps[k] = v
+	}
+	c.collecting = map[Position]int64{}
+	for k, v := range w.collecting {
+		c.collecting[k] = v
+	}
+	c.dying = map[string]int64{}
+	for k, v := range w.dying {
+		c.dying[k] = v
+	}
+	// the events and the checkpoints aren't changed, only their lists
+	c.pending = append([]*worldInput(nil), w.pending...)
+	c.history = append([]*worldInput(nil), w.history...)
+	c.checkpoints = append([]*worldCheckpoint(nil), w.checkpoints...)
+	c.timers = make([]*worldTimer, len(w.timers))
+	for i, t := range w.timers {
+		ct := *t
+		c.timers[i] = &ct
+	}
+	c.outbox = nil
+	return &c
+}
+
+// updateFlameMap calculates flameMap from explodingBombs, a grid in several
+// flames is in the one of the earliest bomb, by the tick it exploded at,
+// then its place in the chain and then its name, so every world credits
+// the same player with a kill there
+func (w *World) updateFlameMap() {
+	bombs := make([]*Bomb, 0, len(w.explodingBombs))
+	for _, bomb := range w.explodingBombs {
+		bombs = append(bombs, bomb)
+	}
+	sort.Slice(bombs, func(i, j int) bool {
+		a, b := bombs[i], bombs[j]
+		if a.explodeTick != b.explodeTick {
+			return a.explodeTick < b.explodeTick
+		}
+		if a.depth != b.depth {
+			return a.depth < b.depth
+		}
+		return a.bombName < b.bombName
+	})
+	newFlameMap := map[Position]*Bomb{}
+	for _, bomb := range bombs {
+		w.settings.getExplodeFlame(bomb.pos, bomb.length, func(p Position) bool {
+			if t, ok := w.obstacleMap[p]; ok && t == indestructibleObstacleType {
+				return false
+			}
+			if _, ok := newFlameMap[p]; !ok {
+				newFlameMap[p] = bomb
+			}
+			return true
+		})
+	}
+	w.flameMap = newFlameMap
+}
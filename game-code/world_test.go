@@ -0,0 +1,279 @@
+package main
+
+import (
+	"testing"
+)
+
+func joinAt(tick int64, name string, x, y int) Event {
+	return &UserJoinEvent{
+		eventHeader: eventHeader{tick: tick},
+		playerInfo:  &playerInfo{name: name, pos: Position{X: x, Y: y}, alive: true},
+	}
+}
+
+func moveTo(tick int64, name string, x, y int) Event {
+	return &UserMoveEvent{
+		eventHeader: eventHeader{tick: tick},
+		playerInfo:  &playerInfo{name: name, pos: Position{X: x, Y: y}, alive: true},
+	}
+}
+
+func bombAt(tick int64, bombName string, x, y int) Event {
+	return &SetBombEvent{
+		eventHeader: eventHeader{tick: tick},
+		bombName:    bombName,
+		pos:         Position{X: x, Y: y},
+	}
+}
+
+// bombNames returns the bombs of the owner the world accepted
+func bombNames(w *World, owner string) []string {
+	var names []string
+	for _, l := range w.bombLives[owner] {
+		names = append(names, l.Name)
+	}
+	return names
+}
+
+func TestWorldApplyIsDeterministic(t *testing.T) {
+	// in the order of the topic, bob's bomb is sent before ann's but
+	// published after it, and chains ann's bomb
+	events := []Event{
+		joinAt(1000, "ann", 5, 5),
+		joinAt(1000, "bob", 9, 5),
+		bombAt(1010, "ann-1", 5, 5),
+		moveTo(1015, "ann", 6, 5),
+		// ann-1 is on the ground
+		bombAt(1020, "ann-2", 6, 5),
+		bombAt(1005, "bob-1", 9, 5),
+		// ann-1 exploded at 1125 by bob-1
+		bombAt(1140, "ann-3", 6, 5),
+	}
+	const end = 1300
+
+	// a world late by two seconds has fired the explosions before bob-1
+	// arrives, and goes back to apply it
+	tests := []struct {
+		name string
+		// the clock before applying the event
+		stepBefore func(e Event) int64
+	}{
+		{name: "in time", stepBefore: func(e Event) int64 { return e.header().tick }},
+		{name: "a second late", stepBefore: func(e Event) int64 { return e.header().tick + ticksPerSecond }},
+		{name: "after the explosions", stepBefore: func(e Event) int64 { return e.header().tick + 2*ticksPerSecond }},
+		{name: "without steps", stepBefore: func(e Event) int64 { return 0 }},
+	}
+	var want string
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := newWorld("", roleObserver, defaultRoomSettings())
+			for _, e := range events {
+				w.Step(tt.stepBefore(e))
+				w.Apply(e)
+			}
+			w.Step(end)
+
+			if got := bombNames(w, "ann"); !equalStrings(got, []string{"ann-1", "ann-3"}) {
+				t.Fatalf("ann set %v, want [ann-1 ann-3]", got)
+			}
+			if _, ok := w.nameToBombs["ann-3"]; ok {
+				t.Fatal("ann-3 isn't exploded")
+			}
+			if _, ok := w.flameMap[Position{X: 6, Y: 5}]; !ok {
+				t.Fatal("the flame of ann-3 is out")
+			}
+			hash := w.stateHash()
+			if want == "" {
+				want = hash
+			}
+			if hash != want {
+				t.Fatalf("hash %s, want %s as applied in time", hash, want)
+			}
+		})
+	}
+}
+
+func TestWorldApplyKeepsClock(t *testing.T) {
+	w := newWorld("", roleObserver, defaultRoomSettings())
+	w.Step(1000)
+	w.Apply(joinAt(1000, "ann", 5, 5))
+	w.Apply(bombAt(1030, "ann-1", 5, 5))
+	if w.tick != 1000 {
+		t.Fatalf("the clock is %d after the event, want 1000", w.tick)
+	}
+	if _, ok := w.nameToBombs["ann-1"]; ok {
+		t.Fatal("ann-1 is set before its tick")
+	}
+	w.Step(1030)
+	if _, ok := w.nameToBombs["ann-1"]; !ok {
+		t.Fatal("ann-1 isn't set at its tick")
+	}
+}
+
+func TestWorldKeepsJudgedDeaths(t *testing.T) {
+	w := newWorld("ann", roleClient, defaultRoomSettings())
+	w.Apply(joinAt(1000, "ann", 5, 5))
+	w.Apply(joinAt(1000, "bob", 9, 9))
+	w.Apply(bombAt(1000, "ann-1", 5, 5))
+	var deaths int
+	countDeaths := func(events []Event) {
+		for _, e := range events {
+			if _, ok := e.(*UserDeadEvent); ok {
+				deaths++
+			}
+		}
+	}
+	countDeaths(w.Step(1130))
+	// a late move takes the world back before the explosion, the death
+	// of ann is on its way
+	w.Apply(moveTo(1050, "bob", 9, 10))
+	countDeaths(w.Step(1131))
+	if deaths != 1 {
+		t.Fatalf("ann died %d times, want once", deaths)
+	}
+	if w.localPlayer().alive {
+		t.Fatal("ann is alive after the rollback")
+	}
+	if w.nameToPlayers["bob"].pos != (Position{X: 9, Y: 10}) {
+		t.Fatal("the late move isn't applied")
+	}
+}
+
+func TestWorldBombsAtEventTick(t *testing.T) {
+	tests := []struct {
+		name string
+		// bombs a player sets at the same time
+		bombs  int
+		events []Event
+		// the clock before applying the last event
+		lastAt int64
+		want   []string
+	}{
+		{
+			name:   "the first is on the ground",
+			bombs:  1,
+			events: []Event{bombAt(1000, "ann-1", 5, 5), moveTo(1050, "ann", 6, 5), bombAt(1100, "ann-2", 6, 5)},
+			want:   []string{"ann-1"},
+		},
+		{
+			name:   "the first exploded",
+			bombs:  1,
+			events: []Event{bombAt(1000, "ann-1", 5, 5), bombAt(1130, "ann-2", 5, 5)},
+			want:   []string{"ann-1", "ann-2"},
+		},
+		{
+			name:   "the first exploded by the clock after the event",
+			bombs:  1,
+			events: []Event{bombAt(1000, "ann-1", 5, 5), moveTo(1050, "ann", 6, 5), bombAt(1100, "ann-2", 6, 5)},
+			lastAt: 1125,
+			want:   []string{"ann-1"},
+		},
+		{
+			name:   "within the cooldown",
+			bombs:  2,
+			events: []Event{bombAt(1000, "ann-1", 5, 5), moveTo(1005, "ann", 6, 5), bombAt(1010, "ann-2", 6, 5)},
+			want:   []string{"ann-1"},
+		},
+		{
+			name:   "within the cooldown by the clock after the event",
+			bombs:  2,
+			events: []Event{bombAt(1000, "ann-1", 5, 5), moveTo(1005, "ann", 6, 5), bombAt(1010, "ann-2", 6, 5)},
+			lastAt: 1030,
+			want:   []string{"ann-1"},
+		},
+		{
+			name:   "after the cooldown",
+			bombs:  2,
+			events: []Event{bombAt(1000, "ann-1", 5, 5), moveTo(1005, "ann", 6, 5), bombAt(1018, "ann-2", 6, 5)},
+			want:   []string{"ann-1", "ann-2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settings := defaultRoomSettings()
+			settings.PowerUps.Bombs = tt.bombs
+			w := newWorld("", roleObserver, settings)
+			w.Apply(joinAt(1000, "ann", 5, 5))
+			for i, e := range tt.events {
+				if i == len(tt.events)-1 {
+					w.Step(tt.lastAt)
+				}
+				w.Apply(e)
+			}
+			w.Step(tt.events[len(tt.events)-1].header().tick)
+			if got := bombNames(w, "ann"); !equalStrings(got, tt.want) {
+				t.Fatalf("ann set %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWorldCreditsKills(t *testing.T) {
+	tests := []struct {
+		name   string
+		events []Event
+		// the deaths are judged at tick
+		tick int64
+		// the killer of every player
+		want map[string]string
+	}{
+		{
+			name: "a chain is credited to its first bomb",
+			events: []Event{
+				joinAt(1000, "ann", 5, 5),
+				joinAt(1000, "bob", 8, 5),
+				joinAt(1000, "cat", 8, 8),
+				bombAt(1000, "ann-1", 5, 5),
+				bombAt(1050, "bob-1", 8, 5),
+			},
+			tick: 1120,
+			want: map[string]string{"ann": "ann", "bob": "ann", "cat": "ann"},
+		},
+		{
+			name: "overlapping flames are credited to the earliest detonation",
+			events: []Event{
+				joinAt(1000, "zed", 5, 5),
+				joinAt(1000, "ann", 9, 9),
+				joinAt(1000, "cat", 5, 9),
+				bombAt(1000, "zed-1", 5, 5),
+				bombAt(1050, "ann-1", 9, 9),
+			},
+			// both flames are on
+			tick: 1170,
+			want: map[string]string{"zed": "zed", "ann": "ann", "cat": "zed"},
+		},
+		{
+			name: "a bomb out of the flame isn't chained",
+			events: []Event{
+				joinAt(1000, "ann", 5, 5),
+				joinAt(1000, "bob", 12, 12),
+				bombAt(1000, "ann-1", 5, 5),
+				bombAt(1050, "bob-1", 12, 12),
+			},
+			tick: 1170,
+			want: map[string]string{"ann": "ann", "bob": "bob"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := newWorld("", roleServer, defaultRoomSettings())
+			for _, e := range tt.events {
+				w.Apply(e)
+			}
+			got := map[string]string{}
+			for _, e := range w.Step(tt.tick) {
+				if dead, ok := e.(*UserDeadEvent); ok {
+					got[dead.name] = dead.killer
+				}
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("killers %v, want %v", got, tt.want)
+			}
+			for name, killer := range tt.want {
+				if got[name] != killer {
+					t.Fatalf("killers %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}